@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archives are read like documents whose rows come from the files inside
+// them. Every member of a supported format is extracted to a temporary file
+// and read by the reader of its format, and its rows are stored under a
+// virtual path naming the archive and the member, e.g.
+// D:\drops\2024-05.zip!/north/customers.csv. The archive itself is what is
+// registered, fingerprinted and removed. Archives inside archives are not
+// opened.
+
+// ARCHIVE_SEPARATOR separates the path of an archive from the name of a
+// member in virtual paths.
+const ARCHIVE_SEPARATOR = "!/"
+
+// ARCHIVE_MEMBER_MAX_MB bounds the size a member is extracted to when
+// imports have no file size limit, so that a small archive cannot fill the
+// disk.
+const ARCHIVE_MEMBER_MAX_MB = 1024
+
+// FILE_ROWS_CONDITION selects the rows of a file and of its archive members
+// in a table with a file column, given the arguments of fileRowsArgs.
+const FILE_ROWS_CONDITION = "(file = ? OR (file >= ? AND file < ?))"
+
+// fileRowsArgs returns the arguments of FILE_ROWS_CONDITION for path. The
+// virtual paths of its members sort from path + "!/" up to path + "!0",
+// '0' following '/'.
+func fileRowsArgs(path string) []interface{} {
+	return []interface{}{path, path + ARCHIVE_SEPARATOR, path + "!0"}
+}
+
+// archiveMemberPath returns the virtual path of the member name of the
+// archive at archivePath.
+func archiveMemberPath(archivePath, name string) string {
+	return archivePath + ARCHIVE_SEPARATOR + name
+}
+
+// splitArchivePath splits a virtual path into the path of the archive and
+// the name of the member. Other paths are returned with an empty member.
+func splitArchivePath(virtual string) (string, string) {
+	if i := strings.Index(virtual, ARCHIVE_SEPARATOR); i >= 0 {
+		return virtual[:i], virtual[i+len(ARCHIVE_SEPARATOR):]
+	}
+	return virtual, ""
+}
+
+// isGzip reports whether head starts a gzip stream.
+func isGzip(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("\x1F\x8B"))
+}
+
+// isTar reports whether head starts a tar archive in the POSIX or GNU
+// format.
+func isTar(head []byte) bool {
+	return len(head) >= 262 && bytes.HasPrefix(head[257:], []byte("ustar"))
+}
+
+// cleanMemberName returns the name of an archive member with forward
+// slashes and without leading "./" or "/".
+func cleanMemberName(name string) string {
+	name = path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	return strings.TrimLeft(strings.TrimPrefix(name, "./"), "/")
+}
+
+// readsMember reports whether the archive member name is read: it is of a
+// supported format and not an archive itself. Folders added by macOS
+// archivers are left out.
+func readsMember(name string) bool {
+	if strings.HasPrefix(name, "__MACOSX/") {
+		return false
+	}
+	format := formatForExtension(filepath.Ext(name))
+	return format != nil && !format.archive
+}
+
+// readZipArchive reads the members of a zip archive.
+func readZipArchive(archivePath string, options ReadOptions, emit func(sheetRow) error) error {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open zip archive: %v", err)
+	}
+	defer archive.Close()
+
+	for _, f := range archive.File {
+		name := cleanMemberName(f.Name)
+		if f.FileInfo().IsDir() || !readsMember(name) {
+			continue
+		}
+		member, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", archiveMemberPath(archivePath, name), err)
+		}
+		err = readArchiveMember(archivePath, name, member, options, emit)
+		member.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readGzipArchive reads a gzip compressed file: the members of a compressed
+// tar archive, or else the single file it holds, named by the gzip header
+// or by the archive's name without its extension.
+func readGzipArchive(archivePath string, options ReadOptions, emit func(sheetRow) error) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decompressed, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("failed to open gzip archive: %v", err)
+	}
+	defer decompressed.Close()
+
+	content := bufio.NewReaderSize(decompressed, SNIFF_LEN)
+	head, err := content.Peek(SNIFF_LEN)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading gzip archive: %v", err)
+	}
+	if isTar(head) {
+		return readTarArchive(archivePath, content, options, emit)
+	}
+
+	name := decompressed.Name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(archivePath), filepath.Ext(archivePath))
+	}
+	name = cleanMemberName(path.Base(strings.ReplaceAll(name, `\`, "/")))
+	if !readsMember(name) {
+		return nil
+	}
+	return readArchiveMember(archivePath, name, content, options, emit)
+}
+
+// readTarArchive reads the regular files of the tar archive r, read from
+// the file at archivePath.
+func readTarArchive(archivePath string, r io.Reader, options ReadOptions, emit func(sheetRow) error) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar archive: %v", err)
+		}
+
+		name := cleanMemberName(header.Name)
+		if header.Typeflag != tar.TypeReg || !readsMember(name) {
+			continue
+		}
+		if err := readArchiveMember(archivePath, name, archive, options, emit); err != nil {
+			return err
+		}
+	}
+}
+
+// readArchiveMember extracts the member name, read from r, to a temporary
+// file and reads it with the reader of its format, calling emit with its
+// rows under its virtual path. Members larger than the file size limit of
+// imports, or ARCHIVE_MEMBER_MAX_MB without one, fail the archive.
+func readArchiveMember(archivePath, name string, r io.Reader, options ReadOptions, emit func(sheetRow) error) error {
+	virtual := archiveMemberPath(archivePath, name)
+	ext := normalizeExtension(filepath.Ext(name))
+
+	temp, err := os.CreateTemp("", "finder-*."+ext)
+	if err != nil {
+		return fmt.Errorf("error extracting %s: %v", virtual, err)
+	}
+	defer os.Remove(temp.Name())
+
+	limit := importSettings.MaxFileSizeMB
+	if limit == 0 {
+		limit = ARCHIVE_MEMBER_MAX_MB
+	}
+	size, err := io.Copy(temp, io.LimitReader(r, limit<<20+1))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error extracting %s: %v", virtual, err)
+	}
+	if size > limit<<20 {
+		return fmt.Errorf("file %s is larger than the %d MB limit", virtual, limit)
+	}
+
+	log.Printf("Extracted %s to %s", virtual, temp.Name())
+	format, err := formatForFile(temp.Name(), ext)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", virtual, err)
+	}
+	if format.archive {
+		log.Printf("Warning: Skipping %s: archives inside archives are not read", virtual)
+		return nil
+	}
+
+	err = format.reader.Read(temp.Name(), options, func(row sheetRow) error {
+		row.file = virtual
+		if row.skipped != nil {
+			row.skipped.File = virtual
+		}
+		return emit(row)
+	})
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", virtual, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadZipArchiveMembers(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "drop.zip")
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	members := map[string]string{
+		"north/customers.csv":   "Name,City\nAn,Hanoi\nBinh,Hue\n",
+		"notes.txt":             "not a spreadsheet\n",
+		"nested.zip":            "PK\x05\x06" + strings.Repeat("\x00", 18),
+		"__MACOSX/._orders.csv": "Name\nresource fork\n",
+	}
+	for name, content := range members {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// Members are read whatever the extensions of the import
+	var rows []string
+	err = readZipArchive(archivePath, ReadOptions{}, func(row sheetRow) error {
+		rows = append(rows, row.file+": "+row.content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		archivePath + "!/north/customers.csv: An - Hanoi",
+		archivePath + "!/north/customers.csv: Binh - Hue",
+	}
+	if strings.Join(rows, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows %q; want %q", rows, want)
+	}
+}
+
+func TestReadArchiveMemberSizeLimit(t *testing.T) {
+	saved := importSettings
+	defer func() { importSettings = saved }()
+	importSettings.MaxFileSizeMB = 1
+
+	options := ReadOptions{}
+	atLimit := strings.Repeat("a\n", 1<<19)
+	rows := 0
+	err := readArchiveMember("drop.zip", "data.csv", strings.NewReader(atLimit), options, func(row sheetRow) error {
+		if row.file != "drop.zip!/data.csv" {
+			t.Fatalf("row of %q; want drop.zip!/data.csv", row.file)
+		}
+		rows++
+		return nil
+	})
+	if err != nil || rows == 0 {
+		t.Errorf("member of 1 MB: %d rows, %v; want rows", rows, err)
+	}
+
+	err = readArchiveMember("drop.zip", "data.csv", strings.NewReader(atLimit+"b"), options, func(sheetRow) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "larger than the 1 MB limit") {
+		t.Errorf("member over 1 MB: %v; want the size limit error", err)
+	}
+}
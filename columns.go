@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Rows keep their cell values as a JSON array in the cells column, indexed
+// by spreadsheet column, and every sheet stores its header row once in the
+// sheet_headers table. Together they give each value its column name.
+
+// normalizeHeaders cleans up a header row: names are trimmed, blank headers
+// are named after their column letter and repeated names get a suffix so
+// every column can be addressed.
+func normalizeHeaders(row []string) []string {
+	headers := make([]string, len(row))
+	seen := make(map[string]int)
+	for i, name := range row {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			name = columnLetter(i)
+		}
+		key := foldText(name)
+		seen[key]++
+		if n := seen[key]; n > 1 {
+			name = fmt.Sprintf("%s (%d)", name, n)
+		}
+		headers[i] = name
+	}
+	return headers
+}
+
+// columnLetter returns the spreadsheet letter of a 0-based column index.
+func columnLetter(index int) string {
+	name, err := excelize.ColumnNumberToName(index + 1)
+	if err != nil {
+		return fmt.Sprintf("Column%d", index+1)
+	}
+	return name
+}
+
+// encodeCells serializes the values of a row without its trailing blanks.
+func encodeCells(cells []string) string {
+	end := len(cells)
+	for end > 0 && strings.TrimSpace(cells[end-1]) == "" {
+		end--
+	}
+	data, err := json.Marshal(cells[:end])
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+func decodeStrings(data string) []string {
+	var values []string
+	if data == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		return nil
+	}
+	return values
+}
+
+// rowFields pairs the cells of a row with their headers, leaving out blank
+// cells. Columns beyond the header row are named by their letter.
+func rowFields(cellsJSON, headersJSON string) map[string]string {
+	cells := decodeStrings(cellsJSON)
+	if len(cells) == 0 {
+		return nil
+	}
+	headers := decodeStrings(headersJSON)
+
+	fields := make(map[string]string)
+	for i, value := range cells {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		name := columnLetter(i)
+		if i < len(headers) {
+			name = headers[i]
+		}
+		fields[name] = value
+	}
+	return fields
+}
+
+// cellMatch is the SQL function behind column qualifiers such as
+// Phone:0903*. It reports whether the cell under the named header contains
+// words as consecutive tokens, the last one as a prefix when prefix is set.
+// Header names are compared without case or accents.
+func cellMatch(cellsJSON, headersJSON, column, words string, prefix, exact bool) bool {
+	headers := decodeStrings(headersJSON)
+	want := foldText(strings.TrimSpace(column))
+	index := -1
+	for i, name := range headers {
+		if foldText(name) == want {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false
+	}
+
+	cells := decodeStrings(cellsJSON)
+	if index >= len(cells) {
+		return false
+	}
+	value := cells[index]
+	if !exact {
+		value = foldText(value)
+	}
+	return containsTokens(ftsTokens(value), strings.Fields(words), prefix)
+}
+
+// containsTokens reports whether want occurs in tokens as a consecutive run.
+func containsTokens(tokens, want []string, prefix bool) bool {
+	if len(want) == 0 {
+		return false
+	}
+	for start := 0; start+len(want) <= len(tokens); start++ {
+		matched := true
+		for i, word := range want {
+			token := tokens[start+i]
+			last := i == len(want)-1
+			if token != word && !(last && prefix && strings.HasPrefix(token, word)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// createColumnTables adds the cells column to a content table, for databases
+// created before rows kept their cells, and creates the sheet_headers table.
+// Rows imported before then have no cells until their file is re-imported.
+func createColumnTables(database querier, contentTable string) error {
+	if err := addColumnIfMissing(database, contentTable, "cells", "TEXT"); err != nil {
+		return err
+	}
+
+	_, err := database.Exec(`
+		CREATE TABLE IF NOT EXISTS sheet_headers (
+			file TEXT,
+			sheet TEXT,
+			headers TEXT,
+			PRIMARY KEY (file, sheet)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating sheet headers table: %v", err)
+	}
+	return nil
+}
+
+func addColumnIfMissing(database querier, table, column, decl string) error {
+	rows, err := database.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return fmt.Errorf("error reading columns of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("error reading columns of %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading columns of %s: %v", table, err)
+	}
+	rows.Close()
+
+	_, err = database.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	if err != nil {
+		return fmt.Errorf("error adding column %s to %s: %v", column, table, err)
+	}
+	return nil
+}
+
+// hitColumn returns the letter of the first cell of a row that contains one
+// of terms, so a match can point at the cell rather than just the row.
+func hitColumn(cellsJSON string, terms []*queryNode, exact bool) string {
+	for i, value := range decodeStrings(cellsJSON) {
+		if !exact {
+			value = foldText(value)
+		}
+		tokens := ftsTokens(value)
+		for _, term := range terms {
+			if containsTokens(tokens, term.words, term.prefix) {
+				return columnLetter(i)
+			}
+		}
+	}
+	return ""
+}
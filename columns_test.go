@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRowFields(t *testing.T) {
+	tests := []struct {
+		cells   string
+		headers string
+		want    map[string]string
+	}{
+		{`["An","0903 123 456","Hà Nội"]`, `["Name","Phone","City"]`,
+			map[string]string{"Name": "An", "Phone": "0903 123 456", "City": "Hà Nội"}},
+		// Blank cells are left out
+		{`["An","","  ","Hà Nội"]`, `["Name","Phone","Email","City"]`,
+			map[string]string{"Name": "An", "City": "Hà Nội"}},
+		// Cells beyond the header row are named by their column letter
+		{`["An","x","y"]`, `["Name"]`, map[string]string{"Name": "An", "B": "x", "C": "y"}},
+		{`["An"]`, ``, map[string]string{"A": "An"}},
+		// Rows imported before cells were kept
+		{``, `["Name"]`, nil},
+		{`[]`, `["Name"]`, nil},
+		{`not json`, `["Name"]`, nil},
+	}
+
+	for _, test := range tests {
+		got := rowFields(test.cells, test.headers)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("rowFields(%s, %s) = %v; want %v", test.cells, test.headers, got, test.want)
+		}
+	}
+}
+
+func TestCellMatch(t *testing.T) {
+	cells := `["Nguyễn Văn An","0903 123 456","Acme Corp","acme reseller"]`
+	headers := `["Name","Phone","Company Name","Note"]`
+
+	tests := []struct {
+		column string
+		words  string
+		prefix bool
+		exact  bool
+		want   bool
+	}{
+		{"Phone", "0903", false, false, true},
+		{"Phone", "09", false, false, false},
+		{"Phone", "09", true, false, true},
+		{"Phone", "123 456", false, false, true},
+		{"Phone", "456 123", false, false, false},
+		{"Phone", "0903 12", true, false, true},
+		{"Phone", "090 123", true, false, false}, // only the last word is a prefix
+
+		// Header names are compared without case, accents or surrounding
+		// spaces
+		{"company name", "acme", false, false, true},
+		{" COMPANY NAME ", "corp", false, false, true},
+		{"Company", "acme", false, false, false},
+		{"Missing", "acme", false, false, false},
+
+		// Only the cell under the column is checked
+		{"Company Name", "reseller", false, false, false},
+		{"Note", "reseller", false, false, true},
+
+		// Values are folded unless exact
+		{"Name", "nguyen van", false, false, true},
+		{"Name", "nguyen", false, true, false},
+		{"Name", "nguyễn", false, true, true},
+
+		{"Name", "", false, false, false},
+	}
+
+	for _, test := range tests {
+		got := cellMatch(cells, headers, test.column, test.words, test.prefix, test.exact)
+		if got != test.want {
+			t.Errorf("cellMatch(%q, %q, prefix=%v, exact=%v) = %v; want %v",
+				test.column, test.words, test.prefix, test.exact, got, test.want)
+		}
+	}
+
+	// Columns past the end of the row's cells never match
+	if cellMatch(`["An"]`, headers, "Phone", "0903", true, false) {
+		t.Error("cellMatch matched a column the row has no cell for")
+	}
+}
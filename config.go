@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// CONFIG_PATH is the optional configuration file read at startup, unless
+// another one is given with -config or FINDER_CONFIG.
+const CONFIG_PATH = "finder.json"
+
+// Config holds the settings of the service. They are read from the
+// configuration file, then overridden by FINDER_* environment variables and
+// by command-line flags. Relative paths are relative to the working
+// directory.
+type Config struct {
+	// Addr is the address the web server listens on
+	Addr string `json:"addr"`
+	// DataDir holds the databases unless Database or EmailDatabase give
+	// other paths
+	DataDir       string `json:"dataDir"`
+	Database      string `json:"database"`
+	EmailDatabase string `json:"emailDatabase"`
+	StaticDir     string `json:"staticDir"`
+	LogFile       string `json:"logFile"`
+
+	Import ImportSettings `json:"import"`
+
+	// Watch lists folders that are imported automatically when their
+	// spreadsheets change
+	Watch []WatchConfig `json:"watch"`
+	// Schedules lists imports run periodically on a cron schedule
+	Schedules []ScheduleConfig `json:"schedules"`
+}
+
+// ImportSettings tune and limit imports. Zero means the default, or no
+// limit.
+type ImportSettings struct {
+	// Workers is how many files are read at once, the number of CPUs by
+	// default
+	Workers int `json:"workers"`
+	// MaxFileSizeMB makes larger files fail to import
+	MaxFileSizeMB int64 `json:"maxFileSizeMB"`
+	// MaxFiles makes imports of more files fail before they start
+	MaxFiles int `json:"maxFiles"`
+}
+
+// importSettings are the import settings of the running service.
+var importSettings ImportSettings
+
+func (s ImportSettings) workers() int {
+	if s.Workers > 0 {
+		return s.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Addr:      ":8080",
+		DataDir:   ".",
+		StaticDir: "static",
+		LogFile:   "finder.log",
+	}
+}
+
+// setting is a configuration value that can be overridden by an environment
+// variable and a flag.
+type setting struct {
+	flag, env, usage string
+	value            flag.Value
+}
+
+func settings(c *Config) []setting {
+	return []setting{
+		{"addr", "FINDER_ADDR", "address the web server listens on", (*stringValue)(&c.Addr)},
+		{"data-dir", "FINDER_DATA_DIR", "directory of the databases", (*stringValue)(&c.DataDir)},
+		{"db", "FINDER_DB", "path of the main database", (*stringValue)(&c.Database)},
+		{"email-db", "FINDER_EMAIL_DB", "path of the email database", (*stringValue)(&c.EmailDatabase)},
+		{"static-dir", "FINDER_STATIC_DIR", "directory of the web interface", (*stringValue)(&c.StaticDir)},
+		{"log-file", "FINDER_LOG_FILE", "log file", (*stringValue)(&c.LogFile)},
+		{"workers", "FINDER_WORKERS", "files read at once by imports", (*intValue)(&c.Import.Workers)},
+		{"max-file-size-mb", "FINDER_MAX_FILE_SIZE_MB", "size limit of imported files in MB", (*int64Value)(&c.Import.MaxFileSizeMB)},
+		{"max-files", "FINDER_MAX_FILES", "limit of files per import", (*intValue)(&c.Import.MaxFiles)},
+	}
+}
+
+// newFlagSet returns the command-line flags setting c and configPath.
+func newFlagSet(c *Config, configPath *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("finder", flag.ContinueOnError)
+	flags.StringVar(configPath, "config", *configPath, "configuration file (env FINDER_CONFIG)")
+	for _, s := range settings(c) {
+		flags.Var(s.value, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	return flags
+}
+
+// loadSettings builds the configuration from the configuration file, the
+// environment and the flags in args, and returns the arguments left after
+// the flags.
+func loadSettings(args []string) (*Config, []string, error) {
+	// The flags are parsed once to find the configuration file, then again
+	// over its settings
+	configPath := envOr("FINDER_CONFIG", CONFIG_PATH)
+	if err := newFlagSet(defaultConfig(), &configPath).Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range settings(config) {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.value.Set(value); err != nil {
+				return nil, nil, fmt.Errorf("invalid %s %q: %v", s.env, value, err)
+			}
+		}
+	}
+	flags := newFlagSet(config, &configPath)
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if config.Database == "" {
+		config.Database = filepath.Join(config.DataDir, DB_PATH)
+	}
+	if config.EmailDatabase == "" {
+		config.EmailDatabase = filepath.Join(config.DataDir, EMAIL_DB_PATH)
+	}
+	if config.Import.Workers < 0 || config.Import.MaxFileSizeMB < 0 || config.Import.MaxFiles < 0 {
+		return nil, nil, fmt.Errorf("import settings cannot be negative")
+	}
+	return config, flags.Args(), nil
+}
+
+func envOr(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// loadConfig reads the configuration file at path over the defaults. A
+// missing file gives the default configuration.
+func loadConfig(path string) (*Config, error) {
+	config := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config %s: %v", path, err)
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing config %s: %v", path, err)
+	}
+
+	for i := range config.Watch {
+		if err := config.Watch[i].validate(); err != nil {
+			return nil, fmt.Errorf("error in config %s: watch %d: %v", path, i+1, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range config.Schedules {
+		schedule := &config.Schedules[i]
+		if err := schedule.validate(); err != nil {
+			return nil, fmt.Errorf("error in config %s: schedule %d: %v", path, i+1, err)
+		}
+		if names[schedule.Name] {
+			return nil, fmt.Errorf("error in config %s: duplicate schedule name %q", path, schedule.Name)
+		}
+		names[schedule.Name] = true
+	}
+	return config, nil
+}
+
+// flag.Value implementations writing into Config fields
+type (
+	stringValue string
+	intValue    int
+	int64Value  int64
+)
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return string(*v)
+}
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("not a number")
+	}
+	*v = intValue(n)
+	return nil
+}
+
+func (v *intValue) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*v))
+}
+
+func (v *int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("not a number")
+	}
+	*v = int64Value(n)
+	return nil
+}
+
+func (v *int64Value) String() string {
+	if v == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*v), 10)
+}
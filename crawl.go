@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies accepted in ImportRequest.Symlinks
+const (
+	SYMLINKS_SKIP   = "skip"
+	SYMLINKS_FOLLOW = "follow"
+)
+
+// SkippedPath is a path met while crawling an import root that could not
+// be imported, with the reason.
+type SkippedPath struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// crawler walks import roots. Its options come from ImportRequest.
+type crawler struct {
+	include    []string
+	exclude    []string
+	extensions []string
+	maxDepth   int
+	follow     bool
+
+	files   []string
+	skipped []SkippedPath
+	// walking holds the real paths of the directories from the root to the
+	// one being walked, so that a link back to one of them is not followed
+	walking map[string]bool
+}
+
+func newCrawler(req ImportRequest) *crawler {
+	return &crawler{
+		include:    lowerAll(req.Include),
+		exclude:    lowerAll(req.Exclude),
+		extensions: req.Extensions,
+		maxDepth:   req.MaxDepth,
+		follow:     req.Symlinks == SYMLINKS_FOLLOW,
+		walking:    make(map[string]bool),
+	}
+}
+
+// validateCrawl checks the crawl options of req.
+func validateCrawl(req ImportRequest) error {
+	switch req.Symlinks {
+	case "", SYMLINKS_SKIP, SYMLINKS_FOLLOW:
+	default:
+		return fmt.Errorf("invalid symlinks policy %q", req.Symlinks)
+	}
+	if req.MaxDepth < 0 {
+		return fmt.Errorf("maxDepth cannot be negative")
+	}
+	for _, pattern := range lowerAll(append(append([]string{}, req.Include...), req.Exclude...)) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q", pattern)
+		}
+	}
+	return nil
+}
+
+// crawlRoots walks every root and returns the files found that have one of
+// the request's extensions and pass the include and exclude globs, in walk
+// order, and the paths it had to skip.
+func crawlRoots(ctx context.Context, req ImportRequest) ([]string, []SkippedPath, error) {
+	c := newCrawler(req)
+	for _, root := range req.Roots {
+		root = filepath.Clean(strings.TrimSpace(root))
+		info, err := os.Stat(root)
+		if err != nil {
+			c.skip(root, err.Error())
+			continue
+		}
+		if !info.IsDir() {
+			c.skip(root, "not a directory")
+			continue
+		}
+		if err := c.walk(ctx, root, root, 1); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c.files, c.skipped, nil
+}
+
+// walk adds the files under dir, which is depth levels below root.
+func (c *crawler) walk(ctx context.Context, root, dir string, depth int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	realPath, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		c.skip(dir, err.Error())
+		return nil
+	}
+	// A directory reached through two links is walked under both paths,
+	// but one containing a link back to itself or a parent is not
+	if c.walking[realPath] {
+		c.skip(dir, "symlink loop")
+		return nil
+	}
+	c.walking[realPath] = true
+	defer delete(c.walking, realPath)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		c.skip(dir, err.Error())
+		return nil
+	}
+
+	for _, entry := range entries {
+		full := filepath.Join(dir, entry.Name())
+		rel, _ := filepath.Rel(root, full)
+		if c.matches(c.exclude, rel) {
+			continue
+		}
+
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 {
+			if !c.follow {
+				c.skip(full, "symlink")
+				continue
+			}
+			info, err := os.Stat(full)
+			if err != nil {
+				c.skip(full, err.Error())
+				continue
+			}
+			isDir = info.IsDir()
+		} else if !isDir && !entry.Type().IsRegular() {
+			continue
+		}
+
+		if isDir {
+			if c.maxDepth == 0 || depth < c.maxDepth {
+				if err := c.walk(ctx, root, full, depth+1); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if allowedExtension(full, c.extensions) == "" {
+			continue
+		}
+		if len(c.include) == 0 || c.matches(c.include, rel) {
+			c.files = append(c.files, full)
+		}
+	}
+	return nil
+}
+
+// allowed reports whether a crawl would import rel, a path relative to the
+// root, or enter it when it is a directory.
+func (c *crawler) allowed(rel string, isDir bool) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	depth := len(parts)
+	if isDir {
+		depth++
+	}
+	if c.maxDepth > 0 && depth > c.maxDepth {
+		return false
+	}
+	for i := range parts {
+		if c.matches(c.exclude, strings.Join(parts[:i+1], "/")) {
+			return false
+		}
+	}
+	return isDir || len(c.include) == 0 || c.matches(c.include, rel)
+}
+
+func (c *crawler) skip(name, reason string) {
+	c.skipped = append(c.skipped, SkippedPath{Path: name, Reason: reason})
+}
+
+// matches reports whether rel, a path relative to the crawl root, matches
+// one of patterns. Patterns with a slash match the whole relative path,
+// others its last element, both without regard to case.
+func (c *crawler) matches(patterns []string, rel string) bool {
+	rel = strings.ToLower(filepath.ToSlash(rel))
+	base := path.Base(rel)
+	for _, pattern := range patterns {
+		name := base
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerAll(values []string) []string {
+	var lowered []string
+	for _, value := range values {
+		value = strings.ToLower(strings.TrimSpace(strings.ReplaceAll(value, "\\", "/")))
+		if value != "" {
+			lowered = append(lowered, value)
+		}
+	}
+	return lowered
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCrawlSymlinks(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"data", "other"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"data/a.csv", "data/notes.txt", "other/b.XLSX"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two links to data make a diamond, and data/up a loop
+	links := map[string]string{
+		"first":   "data",
+		"second":  "data",
+		"data/up": "..",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("cannot create symlinks: %v", err)
+		}
+	}
+
+	crawl := func(symlinks string) ([]string, []SkippedPath) {
+		req := ImportRequest{Roots: []string{root}, Extensions: []string{"csv", "xlsx"}, Symlinks: symlinks}
+		files, skipped, err := crawlRoots(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rel []string
+		for _, file := range files {
+			name, _ := filepath.Rel(root, file)
+			rel = append(rel, filepath.ToSlash(name))
+		}
+		sort.Strings(rel)
+		return rel, skipped
+	}
+
+	files, skipped := crawl(SYMLINKS_FOLLOW)
+	want := []string{"data/a.csv", "first/a.csv", "other/b.XLSX", "second/a.csv"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("files followed = %q; want %q", files, want)
+	}
+	loops := 0
+	for _, s := range skipped {
+		if s.Reason == "symlink loop" {
+			loops++
+		}
+	}
+	// data/up, first/up and second/up each lead back to the root
+	if loops != 3 || len(skipped) != 3 {
+		t.Errorf("skipped %v; want the three links back to the root", skipped)
+	}
+
+	files, skipped = crawl(SYMLINKS_SKIP)
+	want = []string{"data/a.csv", "other/b.XLSX"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("files not following links = %q; want %q", files, want)
+	}
+	if len(skipped) != len(links) {
+		t.Errorf("skipped %v; want the %d links", skipped, len(links))
+	}
+}
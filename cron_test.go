@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCronFields(t *testing.T) {
+	bits := func(values ...int) uint64 {
+		var b uint64
+		for _, v := range values {
+			b |= 1 << uint(v)
+		}
+		return b
+	}
+
+	tests := []struct {
+		spec                          string
+		minute, hour, dom, month, dow uint64
+	}{
+		{"0 0 1 1 *", bits(0), bits(0), bits(1), bits(1), bits(0, 1, 2, 3, 4, 5, 6, 7)},
+		{"0,30 8-10 * * *", bits(0, 30), bits(8, 9, 10), 0xFFFFFFFE, 0x1FFE, 0xFF},
+		{"*/20 */8 1-10/3 */5 *", bits(0, 20, 40), bits(0, 8, 16), bits(1, 4, 7, 10), bits(1, 6, 11), 0xFF},
+		{"5/15 0 ? * *", bits(5, 20, 35, 50), bits(0), 0xFFFFFFFE, 0x1FFE, 0xFF},
+		{"0 0 * JAN,jul-Sep MON-FRI", bits(0), bits(0), 0xFFFFFFFE, bits(1, 7, 8, 9), bits(1, 2, 3, 4, 5)},
+		{"0 0 * * sat,sun", bits(0), bits(0), 0xFFFFFFFE, 0x1FFE, bits(0, 6)},
+		// 7 is Sunday too
+		{"0 0 * * 7", bits(0), bits(0), 0xFFFFFFFE, 0x1FFE, bits(0, 7)},
+		{"@monthly", bits(0), bits(0), bits(1), 0x1FFE, 0xFF},
+		{"@HOURLY", bits(0), 0xFFFFFF, 0xFFFFFFFE, 0x1FFE, 0xFF},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.spec, err)
+			continue
+		}
+		got := []uint64{c.minute, c.hour, c.dom, c.month, c.dow}
+		want := []uint64{test.minute, test.hour, test.dom, test.month, test.dow}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("parseCron(%q) field %d = %b; want %b", test.spec, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		spec    string
+		message string
+	}{
+		{"", "must have 5 fields"},
+		{"0 0 * *", "must have 5 fields"},
+		{"0 0 * * * *", "must have 5 fields"},
+		{"60 * * * *", "not between 0 and 59"},
+		{"* 24 * * *", "not between 0 and 23"},
+		{"* * 0 * *", "not between 1 and 31"},
+		{"* * 32 * *", "not between 1 and 31"},
+		{"* * * 13 *", "not between 1 and 12"},
+		{"* * * * 8", "not between 0 and 7"},
+		{"* * * foo *", "not between 1 and 12"},
+		{"10-5 * * * *", "invalid range"},
+		{"*/0 * * * *", "invalid step"},
+		{"*/x * * * *", "invalid step"},
+		{"1,,2 * * * *", "not between 0 and 59"},
+		{"@every 30s", "at least 1m"},
+		{"@every often", "invalid interval"},
+		{"@fortnightly", "must have 5 fields"},
+	}
+	for _, test := range tests {
+		_, err := parseCron(test.spec)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("parseCron(%q) = %v; want an error containing %q", test.spec, err, test.message)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, value string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", value, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	utc := func(value string) time.Time { return at(time.UTC, value) }
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"every quarter hour", "*/15 * * * *", utc("2024-05-03 10:07"), utc("2024-05-03 10:15")},
+		{"the next minute, not the current one", "* * * * *", utc("2024-05-03 10:07").Add(30 * time.Second), utc("2024-05-03 10:08")},
+		{"steps over a range, weekdays", "0 9-17/2 * * mon-fri", utc("2024-05-03 17:30"), utc("2024-05-06 09:00")},
+		{"list of days", "0 0 1,15 * *", utc("2024-05-02 00:00"), utc("2024-05-15 00:00")},
+		{"month names", "0 12 * jan,jul *", utc("2024-02-01 00:00"), utc("2024-07-01 12:00")},
+		{"next year", "0 0 1 jan *", utc("2024-05-01 00:00"), utc("2025-01-01 00:00")},
+		{"@hourly", "@hourly", utc("2024-05-03 10:00"), utc("2024-05-03 11:00")},
+		{"@weekly runs on Sunday", "@weekly", utc("2024-05-01 08:00"), utc("2024-05-05 00:00")},
+		{"7 is Sunday", "0 0 * * 7", utc("2024-09-01 00:00"), utc("2024-09-08 00:00")},
+
+		// Month ends
+		{"31st skips short months", "0 0 31 * *", utc("2024-04-01 00:00"), utc("2024-05-31 00:00")},
+		{"end of December", "59 23 31 12 *", utc("2024-12-31 23:59"), utc("2025-12-31 23:59")},
+		{"29 February waits for a leap year", "0 0 29 2 *", utc("2023-03-01 00:00"), utc("2024-02-29 00:00")},
+		{"30 February never comes", "0 0 30 2 *", utc("2024-01-01 00:00"), time.Time{}},
+
+		// With both day fields restricted either may match
+		{"weekday before day of month", "0 0 13 * fri", utc("2024-09-01 00:00"), utc("2024-09-06 00:00")},
+		{"day of month before weekday", "0 0 13 * fri", utc("2024-09-07 00:00"), utc("2024-09-13 00:00")},
+		{"day of month alone", "0 0 13 * *", utc("2024-09-01 00:00"), utc("2024-09-13 00:00")},
+		{"weekday alone", "0 0 ? * mon", utc("2024-09-01 00:00"), utc("2024-09-02 00:00")},
+
+		// Daylight saving time in New York starts on 10 March 2024, 2:00
+		// becoming 3:00, and ends on 3 November 2024, 2:00 becoming 1:00
+		{"skipped time does not run that day", "30 2 * * *", at(newYork, "2024-03-09 03:00"), at(newYork, "2024-03-11 02:30")},
+		{"hourly across the gap", "0 * * * *", at(newYork, "2024-03-10 01:30"), at(newYork, "2024-03-10 03:00")},
+		{"daily after the gap", "0 9 * * *", at(newYork, "2024-03-09 09:00"), at(newYork, "2024-03-10 09:00")},
+		{"repeated time runs once", "30 1 * * *", at(newYork, "2024-11-03 01:30"), at(newYork, "2024-11-04 01:30")},
+		{"hourly runs in both repeated hours", "0 * * * *", at(newYork, "2024-11-03 01:00"), at(newYork, "2024-11-03 01:00").Add(time.Hour)},
+		{"daily after the repeated hour", "0 9 * * *", at(newYork, "2024-11-02 09:00"), at(newYork, "2024-11-03 09:00")},
+		// In São Paulo daylight saving started at midnight on 4 November 2018
+		{"daily after a skipped midnight", "0 12 * * *", at(saoPaulo, "2018-11-03 12:00"), at(saoPaulo, "2018-11-04 12:00")},
+		{"skipped midnight", "0 0 * * *", at(saoPaulo, "2018-11-03 12:00"), at(saoPaulo, "2018-11-05 00:00")},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.spec)
+		if err != nil {
+			t.Errorf("%s: parseCron(%q): %v", test.name, test.spec, err)
+			continue
+		}
+		if got := c.next(test.from); !got.Equal(test.want) {
+			t.Errorf("%s: next(%v) of %q = %v; want %v", test.name, test.from, test.spec, got, test.want)
+		}
+	}
+}
+
+func TestCronEvery(t *testing.T) {
+	c, err := parseCron("@every 1h30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 5, 3, 10, 0, 30, 500, time.UTC)
+	want := time.Date(2024, 5, 3, 11, 30, 30, 0, time.UTC)
+	if got := c.next(from); !got.Equal(want) {
+		t.Errorf("next(%v) of @every 1h30m = %v; want %v", from, got, want)
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// CSV_SNIFF_LEN is how much of a CSV file is looked at to detect its
+// encoding and dialect.
+const CSV_SNIFF_LEN = 64 << 10
+
+// CSV_MAX_RECORD_SIZE bounds a CSV record, so that a quote left open does
+// not swallow the rest of the file.
+const CSV_MAX_RECORD_SIZE = 1 << 20
+
+// CSV_DELIMITERS are the delimiters detected, in order of preference.
+const CSV_DELIMITERS = ",;\t|"
+
+// Quote characters accepted in CSVOptions.Quote
+const (
+	CSV_QUOTE_DOUBLE = `"`
+	CSV_QUOTE_SINGLE = "'"
+	// CSV_QUOTE_NONE reads quotes as ordinary characters
+	CSV_QUOTE_NONE = "none"
+)
+
+// CSVOptions override the delimiter, quote and encoding detected in CSV
+// files. Empty fields are detected.
+type CSVOptions struct {
+	// Delimiter is a single character, or "tab"
+	Delimiter string `json:"delimiter"`
+	// Quote is CSV_QUOTE_DOUBLE, CSV_QUOTE_SINGLE or CSV_QUOTE_NONE
+	Quote string `json:"quote"`
+	// Encoding is a name such as utf-8, utf-16le, windows-1252 or
+	// windows-1258
+	Encoding string `json:"encoding"`
+}
+
+func (o CSVOptions) validate() error {
+	if _, err := o.delimiter(); err != nil {
+		return err
+	}
+	switch o.Quote {
+	case "", CSV_QUOTE_DOUBLE, CSV_QUOTE_SINGLE, CSV_QUOTE_NONE:
+	default:
+		return fmt.Errorf("invalid CSV quote %q", o.Quote)
+	}
+	if o.Encoding != "" {
+		if _, err := htmlindex.Get(o.Encoding); err != nil {
+			return fmt.Errorf("unknown CSV encoding %q", o.Encoding)
+		}
+	}
+	return nil
+}
+
+// delimiter returns the delimiter set by o, or 0 when it is detected.
+func (o CSVOptions) delimiter() (rune, error) {
+	if o.Delimiter == "" {
+		return 0, nil
+	}
+	if strings.EqualFold(o.Delimiter, "tab") || o.Delimiter == `\t` {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(o.Delimiter)
+	if size != len(o.Delimiter) || r == utf8.RuneError || strings.ContainsRune("\"'\r\n", r) {
+		return 0, fmt.Errorf("invalid CSV delimiter %q", o.Delimiter)
+	}
+	return r, nil
+}
+
+// csvDialect is how a CSV file is written.
+type csvDialect struct {
+	encoding  string
+	delimiter rune
+	quote     string
+}
+
+// readCSVFile reads a CSV file a row at a time, calling emit with every row
+// after the header row. An error returned by emit stops the reading and is
+// returned. Rows may have any number of fields, and rows that cannot be read
+// are emitted as skipped.
+func readCSVFile(path string, options ReadOptions, emit func(sheetRow) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	text, dialect, err := openCSV(file, options.CSV)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reading %s as %s, delimiter %q, quote %s", path, dialect.encoding, dialect.delimiter, dialect.quote)
+
+	parser := newCSVParser(text, dialect)
+	var headers []string
+	rowNum := 0
+	lastLine := 0
+
+	for {
+		record, err := parser.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Blank lines are not records, but a spreadsheet shows them as
+		// empty rows, so the row number advances by the lines in between.
+		// A quoted value spanning lines stays a single row.
+		rowNum += record.first - lastLine
+		lastLine = record.last
+
+		if record.err != nil {
+			if err := emit(sheetRow{sheet: "Sheet1", row: rowNum, skipped: record.err}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if headers == nil {
+			headers = normalizeHeaders(record.fields)
+			continue
+		}
+
+		// Join all values with a separator
+		err = emit(sheetRow{
+			sheet:   "Sheet1",
+			row:     rowNum,
+			content: strings.Join(record.fields, " - "),
+			cells:   encodeCells(record.fields),
+			headers: headers,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if headers == nil {
+		return fmt.Errorf("empty CSV file")
+	}
+	return nil
+}
+
+// openCSV returns the text of a CSV file decoded to UTF-8, without byte
+// order mark, and its dialect, detected from its start unless set by
+// options.
+func openCSV(file io.Reader, options CSVOptions) (io.Reader, csvDialect, error) {
+	var dialect csvDialect
+
+	raw := bufio.NewReaderSize(file, CSV_SNIFF_LEN)
+	head, err := raw.Peek(CSV_SNIFF_LEN)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, dialect, err
+	}
+
+	// A byte order mark overrides the encoding and is dropped
+	enc := bomEncoding(head)
+	switch {
+	case enc != nil:
+	case options.Encoding != "":
+		enc, err = htmlindex.Get(options.Encoding)
+		if err != nil {
+			return nil, dialect, fmt.Errorf("unknown CSV encoding %q", options.Encoding)
+		}
+	default:
+		enc = detectEncoding(head)
+	}
+	dialect.encoding, _ = htmlindex.Name(enc)
+
+	// Windows-1258 writes tone marks as combining characters, which are
+	// composed
+	var decoder transform.Transformer = unicode.BOMOverride(enc.NewDecoder())
+	if enc == charmap.Windows1258 {
+		decoder = transform.Chain(decoder, norm.NFC)
+	}
+	text := bufio.NewReaderSize(transform.NewReader(raw, decoder), CSV_SNIFF_LEN)
+	sample, err := text.Peek(CSV_SNIFF_LEN)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, dialect, err
+	}
+	lines := sampleLines(string(sample), len(sample) == CSV_SNIFF_LEN)
+
+	dialect.delimiter, _ = options.delimiter()
+	if dialect.delimiter == 0 {
+		dialect.delimiter = detectDelimiter(lines)
+	}
+	dialect.quote = options.Quote
+	if dialect.quote == "" {
+		dialect.quote = detectQuote(lines, dialect.delimiter)
+	}
+	return text, dialect, nil
+}
+
+// bomEncoding returns the encoding named by the byte order mark starting
+// head, or nil.
+func bomEncoding(head []byte) encoding.Encoding {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return unicode.UTF8
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+	return nil
+}
+
+// detectEncoding guesses the encoding of a file starting with head. A byte
+// order mark, or NUL bytes in every other position, give UTF-16; text that
+// is valid UTF-8 is UTF-8. Other text is Windows-1258 when it has letters
+// only Vietnamese uses, and Windows-1252 otherwise.
+func detectEncoding(head []byte) encoding.Encoding {
+	if enc := bomEncoding(head); enc != nil {
+		return enc
+	}
+
+	evenNULs, oddNULs := 0, 0
+	for i, b := range head {
+		if b == 0 {
+			if i%2 == 0 {
+				evenNULs++
+			} else {
+				oddNULs++
+			}
+		}
+	}
+	switch {
+	case oddNULs > len(head)/4 && evenNULs == 0:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case evenNULs > len(head)/4 && oddNULs == 0:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+
+	if validUTF8Prefix(head) {
+		return unicode.UTF8
+	}
+
+	// Đ đ Ư ư, and the combining tone marks at Ì Ò Þ þ, are rare in the
+	// languages written in Windows-1252
+	for _, b := range head {
+		switch b {
+		case 0xD0, 0xF0, 0xDD, 0xFD, 0xCC, 0xD2, 0xDE, 0xFE:
+			return charmap.Windows1258
+		}
+	}
+	return charmap.Windows1252
+}
+
+// validUTF8Prefix reports whether head is valid UTF-8, but for a character
+// cut at its end.
+func validUTF8Prefix(head []byte) bool {
+	for len(head) > 0 {
+		r, size := utf8.DecodeRune(head)
+		if r == utf8.RuneError && size == 1 {
+			return len(head) < utf8.UTFMax && !utf8.FullRune(head)
+		}
+		head = head[size:]
+	}
+	return true
+}
+
+// sampleLines splits the start of a file into its non-blank lines, leaving
+// out the last one when cut is set because the sample ends within it.
+func sampleLines(sample string, cut bool) []string {
+	lines := strings.Split(sample, "\n")
+	if cut && len(lines) > 1 {
+		lines = lines[:len(lines)-1]
+	}
+	var nonBlank []string
+	for _, line := range lines {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			nonBlank = append(nonBlank, line)
+		}
+	}
+	return nonBlank
+}
+
+// detectDelimiter returns the delimiter that appears, outside double quotes,
+// the same number of times in the most lines as in the first one. Ties go
+// to the delimiter appearing more often, then to the first in
+// CSV_DELIMITERS; a comma is assumed when none appears.
+func detectDelimiter(lines []string) rune {
+	best, bestLines, bestCount := ',', 0, 0
+	for _, delimiter := range CSV_DELIMITERS {
+		count := -1
+		matching := 0
+		for _, line := range lines {
+			n := 0
+			quoted := false
+			for _, r := range line {
+				switch {
+				case r == '"':
+					quoted = !quoted
+				case r == delimiter && !quoted:
+					n++
+				}
+			}
+			if count < 0 {
+				count = n
+			}
+			if n == count {
+				matching++
+			}
+		}
+		if count <= 0 {
+			continue
+		}
+		if matching > bestLines || (matching == bestLines && count > bestCount) {
+			best, bestLines, bestCount = delimiter, matching, count
+		}
+	}
+	return best
+}
+
+// detectQuote returns CSV_QUOTE_SINGLE when values are quoted with single
+// quotes and never with double quotes, and CSV_QUOTE_DOUBLE otherwise.
+func detectQuote(lines []string, delimiter rune) string {
+	quoted := func(quote string) int {
+		n := 0
+		for _, line := range lines {
+			for _, field := range strings.Split(line, string(delimiter)) {
+				field = strings.TrimSpace(field)
+				if len(field) >= 2 && strings.HasPrefix(field, quote) && strings.HasSuffix(field, quote) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	if quoted(CSV_QUOTE_SINGLE) > 0 && quoted(CSV_QUOTE_DOUBLE) == 0 {
+		return CSV_QUOTE_SINGLE
+	}
+	return CSV_QUOTE_DOUBLE
+}
+
+// csvParser reads CSV records leniently. A quote inside an unquoted value is
+// kept as text, and so is text between a closing quote and the next
+// delimiter, as spreadsheet programs do. A record that cannot be read, such
+// as one whose quoted value is still open at the end of the file or after
+// CSV_MAX_RECORD_SIZE bytes, is returned as skipped and reading resumes on
+// the line after its first one, so one broken line only costs its own row.
+type csvParser struct {
+	r         *bufio.Reader
+	delimiter rune
+	// quote is 0 when values are not quoted
+	quote rune
+
+	// line is the number of the last line read from r, and pending holds
+	// lines read again after a skipped record
+	line    int
+	pending []csvLine
+}
+
+type csvLine struct {
+	text    string
+	number  int
+	tooLong bool
+}
+
+// csvRecord is a record read by csvParser, spanning lines first to last.
+// err is set instead of fields when the record was skipped.
+type csvRecord struct {
+	fields      []string
+	first, last int
+	err         *RowError
+}
+
+func newCSVParser(r io.Reader, dialect csvDialect) *csvParser {
+	p := &csvParser{r: bufio.NewReader(r), delimiter: dialect.delimiter}
+	switch dialect.quote {
+	case CSV_QUOTE_DOUBLE:
+		p.quote = '"'
+	case CSV_QUOTE_SINGLE:
+		p.quote = '\''
+	}
+	return p
+}
+
+// next returns the next record, skipping blank lines, or io.EOF.
+func (p *csvParser) next() (csvRecord, error) {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return csvRecord{}, err
+		}
+		if line.tooLong {
+			return p.skip(line, nil, fmt.Sprintf("row longer than %d bytes", CSV_MAX_RECORD_SIZE)), nil
+		}
+		if line.text != "" {
+			return p.parse(line)
+		}
+	}
+}
+
+// readLine returns the next line without its line ending. Lines longer than
+// CSV_MAX_RECORD_SIZE are returned truncated and flagged.
+func (p *csvParser) readLine() (csvLine, error) {
+	if len(p.pending) > 0 {
+		line := p.pending[0]
+		p.pending = p.pending[1:]
+		return line, nil
+	}
+
+	var line csvLine
+	var buf []byte
+	for {
+		chunk, err := p.r.ReadSlice('\n')
+		if len(buf)+len(chunk) <= CSV_MAX_RECORD_SIZE {
+			buf = append(buf, chunk...)
+		} else {
+			line.tooLong = true
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || (len(buf) == 0 && !line.tooLong)) {
+			return line, err
+		}
+		break
+	}
+	p.line++
+	line.number = p.line
+	line.text = strings.TrimSuffix(strings.TrimSuffix(string(buf), "\n"), "\r")
+	return line, nil
+}
+
+// parse reads the record starting with first, reading more lines while a
+// quoted value is open.
+func (p *csvParser) parse(first csvLine) (csvRecord, error) {
+	var fields []string
+	var value strings.Builder
+	// more are the lines read after first
+	var more []csvLine
+	size := len(first.text)
+	text := first.text
+	i := 0
+
+	for {
+		// An unquoted value runs to the next delimiter
+		if p.quote == 0 || !strings.HasPrefix(text[i:], string(p.quote)) {
+			end := strings.IndexRune(text[i:], p.delimiter)
+			if end < 0 {
+				fields = append(fields, text[i:])
+				break
+			}
+			fields = append(fields, text[i:i+end])
+			i += end + utf8.RuneLen(p.delimiter)
+			continue
+		}
+
+		// A quoted value runs to a quote that is not doubled, possibly on a
+		// later line
+		i++
+		value.Reset()
+		for {
+			end := strings.IndexRune(text[i:], p.quote)
+			if end < 0 {
+				value.WriteString(text[i:])
+				value.WriteByte('\n')
+				line, err := p.readLine()
+				if err == io.EOF {
+					return p.skip(first, more, "quoted value not closed before the end of the file"), nil
+				}
+				if err != nil {
+					return csvRecord{}, err
+				}
+				more = append(more, line)
+				size += len(line.text) + 1
+				if line.tooLong || size > CSV_MAX_RECORD_SIZE {
+					return p.skip(first, more, fmt.Sprintf("quoted value not closed within %d bytes", CSV_MAX_RECORD_SIZE)), nil
+				}
+				text, i = line.text, 0
+				continue
+			}
+			value.WriteString(text[i : i+end])
+			i += end + 1
+			if strings.HasPrefix(text[i:], string(p.quote)) {
+				value.WriteRune(p.quote)
+				i++
+				continue
+			}
+			break
+		}
+
+		// Text after the closing quote is kept up to the delimiter. After a
+		// value spanning lines it rather means the quote opening the value
+		// was never closed, and a later value's opening quote was taken for
+		// its end.
+		end := strings.IndexRune(text[i:], p.delimiter)
+		if len(more) > 0 && end != 0 && i < len(text) {
+			return p.skip(first, more, "quoted value not closed"), nil
+		}
+		if end < 0 {
+			value.WriteString(text[i:])
+			fields = append(fields, value.String())
+			break
+		}
+		value.WriteString(text[i : i+end])
+		fields = append(fields, value.String())
+		i += end + utf8.RuneLen(p.delimiter)
+	}
+
+	last := first.number
+	if len(more) > 0 {
+		last = more[len(more)-1].number
+	}
+	return csvRecord{fields: fields, first: first.number, last: last}, nil
+}
+
+// skip returns the record starting with first as skipped for reason, and
+// puts back the lines read after it to be parsed again.
+func (p *csvParser) skip(first csvLine, more []csvLine, reason string) csvRecord {
+	p.pending = append(more, p.pending...)
+	return csvRecord{
+		first: first.number,
+		last:  first.number,
+		err:   &RowError{Line: first.number, Reason: reason},
+	}
+}
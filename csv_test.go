@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestOpenCSV(t *testing.T) {
+	utf16 := func(s string, endianness unicode.Endianness, bom unicode.BOMPolicy) string {
+		encoded, err := unicode.UTF16(endianness, bom).NewEncoder().String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		options CSVOptions
+		dialect csvDialect
+		text    string
+	}{
+		{
+			name:    "UTF-8",
+			input:   "Tên,Thành phố\nNguyễn Văn An,Đà Nẵng\n",
+			dialect: csvDialect{"utf-8", ',', CSV_QUOTE_DOUBLE},
+			text:    "Tên,Thành phố\nNguyễn Văn An,Đà Nẵng\n",
+		},
+		{
+			name:    "UTF-8 with a byte order mark",
+			input:   "\xEF\xBB\xBFName,City\nAn,Hanoi\n",
+			dialect: csvDialect{"utf-8", ',', CSV_QUOTE_DOUBLE},
+			text:    "Name,City\nAn,Hanoi\n",
+		},
+		{
+			// ễ and ẵ are a letter followed by a combining tilde, 0xDE
+			name:    "Windows-1258",
+			input:   "T\xEAn,Th\xE0nh ph\xF4\nNguy\xEA\xDEn V\xE3n An,\xD0\xE0 N\xE3\xDEng\n",
+			dialect: csvDialect{"windows-1258", ',', CSV_QUOTE_DOUBLE},
+			text:    "Tên,Thành phô\nNguyễn Văn An,Đà Nẵng\n",
+		},
+		{
+			name:    "Windows-1252",
+			input:   "Name,City\nRen\xE9e,Z\xFCrich\n",
+			dialect: csvDialect{"windows-1252", ',', CSV_QUOTE_DOUBLE},
+			text:    "Name,City\nRenée,Zürich\n",
+		},
+		{
+			name:    "UTF-16 little endian with a byte order mark",
+			input:   utf16("Tên;Thành phố\r\nAn;Huế\r\n", unicode.LittleEndian, unicode.UseBOM),
+			dialect: csvDialect{"utf-16le", ';', CSV_QUOTE_DOUBLE},
+			text:    "Tên;Thành phố\r\nAn;Huế\r\n",
+		},
+		{
+			name:    "UTF-16 big endian with a byte order mark",
+			input:   utf16("Tên\tTuổi\nAn\t30\n", unicode.BigEndian, unicode.UseBOM),
+			dialect: csvDialect{"utf-16be", '\t', CSV_QUOTE_DOUBLE},
+			text:    "Tên\tTuổi\nAn\t30\n",
+		},
+		{
+			name:    "UTF-16 without a byte order mark",
+			input:   utf16("Name,City\nAn,Hanoi\n", unicode.LittleEndian, unicode.IgnoreBOM),
+			dialect: csvDialect{"utf-16le", ',', CSV_QUOTE_DOUBLE},
+			text:    "Name,City\nAn,Hanoi\n",
+		},
+		{
+			name:    "semicolons, with commas in the values",
+			input:   "Name;Amount\nAn;1,5\n\"Tran, Binh\";2,25\n",
+			dialect: csvDialect{"utf-8", ';', CSV_QUOTE_DOUBLE},
+		},
+		{
+			name:    "quoted delimiters are not counted",
+			input:   "Name,Note\n\"A;B;C\",x\n\"D;E\",y\n",
+			dialect: csvDialect{"utf-8", ',', CSV_QUOTE_DOUBLE},
+		},
+		{
+			name:    "tabs",
+			input:   "Name\tCity\tPhone\nAn\tHanoi, VN\t0903\n",
+			dialect: csvDialect{"utf-8", '\t', CSV_QUOTE_DOUBLE},
+		},
+		{
+			name:    "pipes",
+			input:   "Name|City\nAn|Hanoi\nBinh|Hue\n",
+			dialect: csvDialect{"utf-8", '|', CSV_QUOTE_DOUBLE},
+		},
+		{
+			name:    "a single column",
+			input:   "Name\nAn\nBinh\n",
+			dialect: csvDialect{"utf-8", ',', CSV_QUOTE_DOUBLE},
+		},
+		{
+			name:    "single quotes",
+			input:   "'Name','City'\n'An','Hanoi'\n",
+			dialect: csvDialect{"utf-8", ',', CSV_QUOTE_SINGLE},
+		},
+		{
+			name:    "double quotes win over apostrophes",
+			input:   "Name,Note\n\"O'Brien\",'quoted'\n",
+			dialect: csvDialect{"utf-8", ',', CSV_QUOTE_DOUBLE},
+		},
+		{
+			name:    "options override detection",
+			input:   "a;b\tc\n\xD0,\xDE\n",
+			options: CSVOptions{Delimiter: "tab", Quote: CSV_QUOTE_NONE, Encoding: "windows-1252"},
+			dialect: csvDialect{"windows-1252", '\t', CSV_QUOTE_NONE},
+			text:    "a;b\tc\nÐ,Þ\n",
+		},
+		{
+			name:    "a byte order mark overrides the encoding option",
+			input:   "\xEF\xBB\xBFa,\xC3\xA9\n",
+			options: CSVOptions{Encoding: "windows-1252"},
+			dialect: csvDialect{"utf-8", ',', CSV_QUOTE_DOUBLE},
+			text:    "a,é\n",
+		},
+	}
+
+	for _, test := range tests {
+		text, dialect, err := openCSV(strings.NewReader(test.input), test.options)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if dialect != test.dialect {
+			t.Errorf("%s: dialect %+v; want %+v", test.name, dialect, test.dialect)
+		}
+		if test.text == "" {
+			continue
+		}
+		decoded, err := io.ReadAll(text)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if string(decoded) != test.text {
+			t.Errorf("%s: text %q; want %q", test.name, decoded, test.text)
+		}
+	}
+}
+
+func TestCSVOptionsValidate(t *testing.T) {
+	valid := []CSVOptions{
+		{},
+		{Delimiter: ";", Quote: CSV_QUOTE_SINGLE, Encoding: "windows-1258"},
+		{Delimiter: "tab", Quote: CSV_QUOTE_NONE, Encoding: "utf-16le"},
+		{Delimiter: `\t`},
+	}
+	for _, options := range valid {
+		if err := options.validate(); err != nil {
+			t.Errorf("%+v: %v", options, err)
+		}
+	}
+
+	invalid := []CSVOptions{
+		{Delimiter: ";;"},
+		{Delimiter: `"`},
+		{Delimiter: "\n"},
+		{Quote: "`"},
+		{Encoding: "klingon"},
+	}
+	for _, options := range invalid {
+		if err := options.validate(); err == nil {
+			t.Errorf("%+v is valid; want an error", options)
+		}
+	}
+}
+
+// parseCSV reads every record of input and describes each as
+// "first-last: fields" with the fields joined by |, or as
+// "first: skipped, reason".
+func parseCSV(t *testing.T, input string, delimiter rune, quote string) []string {
+	p := newCSVParser(strings.NewReader(input), csvDialect{delimiter: delimiter, quote: quote})
+	var records []string
+	for {
+		r, err := p.next()
+		if err == io.EOF {
+			return records
+		}
+		if err != nil {
+			t.Fatalf("%.100q: %v", input, err)
+		}
+		if r.err != nil {
+			if r.err.Line != r.first || r.last != r.first {
+				t.Errorf("skipped record at lines %d-%d reports line %d", r.first, r.last, r.err.Line)
+			}
+			records = append(records, fmt.Sprintf("%d: skipped, %s", r.first, r.err.Reason))
+			continue
+		}
+		records = append(records, fmt.Sprintf("%d-%d: %s", r.first, r.last, strings.Join(r.fields, "|")))
+	}
+}
+
+func TestCSVParser(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		delimiter rune
+		quote     string
+		want      []string
+	}{
+		{"plain", "a,b,c\nd,e\n", ',', CSV_QUOTE_DOUBLE, []string{"1-1: a|b|c", "2-2: d|e"}},
+		{"no final line ending", "a,b\nc,d", ',', CSV_QUOTE_DOUBLE, []string{"1-1: a|b", "2-2: c|d"}},
+		{"CRLF", "a,b\r\nc,d\r\n", ',', CSV_QUOTE_DOUBLE, []string{"1-1: a|b", "2-2: c|d"}},
+		{"blank lines are skipped", "a\n\n\nb\n", ',', CSV_QUOTE_DOUBLE, []string{"1-1: a", "4-4: b"}},
+		{"empty fields", ",a,,\n", ',', CSV_QUOTE_DOUBLE, []string{"1-1: |a||"}},
+		{"semicolons", "a;\"b;c\";d\n", ';', CSV_QUOTE_DOUBLE, []string{"1-1: a|b;c|d"}},
+		{"tabs", "a\tb c\t\"d\te\"\n", '\t', CSV_QUOTE_DOUBLE, []string{"1-1: a|b c|d\te"}},
+		{"pipes", "a|b,c|d\n", '|', CSV_QUOTE_DOUBLE, []string{"1-1: a|b,c|d"}},
+		{"doubled quotes", "\"say \"\"hi\"\"\",b\n", ',', CSV_QUOTE_DOUBLE, []string{`1-1: say "hi"|b`}},
+		{"value over lines", "\"a\nb\",c\nd\n", ',', CSV_QUOTE_DOUBLE, []string{"1-2: a\nb|c", "3-3: d"}},
+		{"single quotes", "'a,b','it''s',\"c\"\n", ',', CSV_QUOTE_SINGLE, []string{`1-1: a,b|it's|"c"`}},
+		{"no quotes", "\"a,b\",'c'\n", ',', CSV_QUOTE_NONE, []string{`1-1: "a|b"|'c'`}},
+
+		// Stray quotes are kept as text
+		{"quote inside an unquoted value", "5\" disk,b\"c\"d,e\n", ',', CSV_QUOTE_DOUBLE, []string{`1-1: 5" disk|b"c"d|e`}},
+		{"text after a closing quote", "\"a\"b,c\n", ',', CSV_QUOTE_DOUBLE, []string{"1-1: ab|c"}},
+		{"apostrophe inside a value", "O'Brien,b\n", ',', CSV_QUOTE_SINGLE, []string{"1-1: O'Brien|b"}},
+
+		// An unclosed quote costs only its own line
+		{
+			"quote not closed before the end",
+			"a,b\nc,\"d\ne,f\ng,h\n", ',', CSV_QUOTE_DOUBLE,
+			[]string{"1-1: a|b", "2: skipped, quoted value not closed before the end of the file", "3-3: e|f", "4-4: g|h"},
+		},
+		{
+			"quote closed by a later value's opening quote",
+			"\"a,b\nc,\"d\"\ne,f\n", ',', CSV_QUOTE_DOUBLE,
+			[]string{"1: skipped, quoted value not closed", "2-2: c|d", "3-3: e|f"},
+		},
+		{
+			"unclosed quote after blank lines",
+			"a\n\n\"b\n\nc\n", ',', CSV_QUOTE_DOUBLE,
+			[]string{"1-1: a", "3: skipped, quoted value not closed before the end of the file", "5-5: c"},
+		},
+	}
+
+	for _, test := range tests {
+		got := parseCSV(t, test.input, test.delimiter, test.quote)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q; want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCSVParserRecordSize(t *testing.T) {
+	// A row at the limit with its line ending
+	long := strings.Repeat("x", CSV_MAX_RECORD_SIZE-1)
+
+	// A quote left open over more than the limit skips its first line only
+	line := strings.Repeat("y", 1000)
+	open := "\"a\n"
+	unclosed := []string{fmt.Sprintf("1: skipped, quoted value not closed within %d bytes", CSV_MAX_RECORD_SIZE)}
+	for n := 2; len(open) <= CSV_MAX_RECORD_SIZE; n++ {
+		open += line + "\n"
+		unclosed = append(unclosed, fmt.Sprintf("%d-%d: %s", n, n, line))
+	}
+	unclosed = append(unclosed, fmt.Sprintf("%d-%d: b", len(unclosed)+1, len(unclosed)+1))
+
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"a row at the limit", long + "\nb\n", []string{"1-1: " + long, "2-2: b"}},
+		{"a row over the limit", "a\n" + long + "zz\nb\n", []string{"1-1: a", fmt.Sprintf("2: skipped, row longer than %d bytes", CSV_MAX_RECORD_SIZE), "3-3: b"}},
+		{"a row over the limit at the end", "a\n" + long + "zz", []string{"1-1: a", fmt.Sprintf("2: skipped, row longer than %d bytes", CSV_MAX_RECORD_SIZE)}},
+		{"a quoted value over the limit", open + "b\n", unclosed},
+	}
+
+	for _, test := range tests {
+		if got := parseCSV(t, test.input, ',', CSV_QUOTE_DOUBLE); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %.200q; want %.200q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field qualifiers understood in search queries
+const (
+	FILTER_FILE  = "file"
+	FILTER_SHEET = "sheet"
+	FILTER_ROW   = "row"
+	FILTER_EMAIL = "email"
+
+	// FILTER_COLUMN is used for any other qualifier, which names a column
+	// header: Phone:0903*
+	FILTER_COLUMN = "column"
+)
+
+// Filters taken from SearchRequest.Directories and SearchRequest.Extensions.
+// Each holds a list of values of which any may match.
+const (
+	FILTER_DIRECTORIES = "directories"
+	FILTER_EXTENSIONS  = "extensions"
+)
+
+func isFilterField(field string) bool {
+	switch field {
+	case FILTER_FILE, FILTER_SHEET, FILTER_ROW, FILTER_EMAIL:
+		return true
+	}
+	return false
+}
+
+// searchFilter restricts search results on one field. Filters come from
+// qualifiers in the query (sheet:Customers) or from SearchRequest.Filters.
+type searchFilter struct {
+	field   string
+	value   string
+	values  []string // alternatives for directory and extension filters
+	rowFrom int      // row range, 0 when open-ended
+	rowTo   int
+	negate  bool
+
+	// Column filters match the tokenized words in the cell under column
+	column string
+	words  []string
+	prefix bool
+	exact  bool
+}
+
+func newSearchFilter(field, value string) (searchFilter, error) {
+	filter := searchFilter{field: field, value: strings.TrimSpace(value)}
+	if field == FILTER_ROW {
+		from, to, err := parseRowRange(filter.value)
+		if err != nil {
+			return filter, err
+		}
+		filter.rowFrom, filter.rowTo = from, to
+	}
+	return filter, nil
+}
+
+// parseRowRange parses "10", "10-20", "10-" or "-20".
+func parseRowRange(value string) (int, int, error) {
+	fromText, toText, isRange := strings.Cut(value, "-")
+	if !isRange {
+		toText = fromText
+	}
+
+	parse := func(text string) (int, error) {
+		if text == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("row: expects a row number or range like 10-20, got %q", value)
+		}
+		return n, nil
+	}
+
+	from, err := parse(fromText)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parse(toText)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == 0 && to == 0 {
+		return 0, 0, fmt.Errorf("row: expects a row number or range like 10-20, got %q", value)
+	}
+	if to != 0 && from > to {
+		return 0, 0, fmt.Errorf("row: range %q ends before it starts", value)
+	}
+	return from, to, nil
+}
+
+// requestFilters converts the structured filters of a search request.
+func requestFilters(f SearchFilters) []searchFilter {
+	var filters []searchFilter
+	if f.File != "" {
+		filters = append(filters, searchFilter{field: FILTER_FILE, value: f.File})
+	}
+	if f.Sheet != "" {
+		filters = append(filters, searchFilter{field: FILTER_SHEET, value: f.Sheet})
+	}
+	if f.RowFrom > 0 || f.RowTo > 0 {
+		filters = append(filters, searchFilter{field: FILTER_ROW, rowFrom: f.RowFrom, rowTo: f.RowTo})
+	}
+	if f.EmailDomain != "" {
+		filters = append(filters, searchFilter{field: FILTER_EMAIL, value: f.EmailDomain})
+	}
+	return filters
+}
+
+// scopeFilters converts the directories and extensions selected in the UI.
+// Directories are normalized to slash separators without a trailing slash
+// and extensions to lower case without a leading dot; blank entries are
+// ignored.
+func scopeFilters(directories, extensions []string) []searchFilter {
+	var filters []searchFilter
+
+	var dirs []string
+	for _, dir := range directories {
+		dir = strings.TrimSpace(strings.ReplaceAll(dir, "\\", "/"))
+		if dir == "" {
+			continue
+		}
+		dirs = append(dirs, strings.TrimRight(foldText(dir), "/"))
+	}
+	if len(dirs) > 0 {
+		filters = append(filters, searchFilter{field: FILTER_DIRECTORIES, values: dirs})
+	}
+
+	var exts []string
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	if len(exts) > 0 {
+		filters = append(filters, searchFilter{field: FILTER_EXTENSIONS, values: exts})
+	}
+	return filters
+}
+
+// where renders the filter as an SQL condition on the content table aliased
+// as c, joined to its sheet_headers row aliased as h. Paths and sheet names
+// are compared folded, so case and accents are ignored, and with Windows
+// separators normalized to slashes.
+func (f searchFilter) where(emailOnly bool) (string, []interface{}) {
+	var clause string
+	var args []interface{}
+
+	switch f.field {
+	case FILTER_FILE:
+		clause = "fold(replace(c.file, '\\', '/')) GLOB ?"
+		args = append(args, globPattern(strings.ReplaceAll(f.value, "\\", "/"), true))
+
+	case FILTER_SHEET:
+		if hasGlob(f.value) {
+			clause = "fold(c.sheet) GLOB ?"
+			args = append(args, globPattern(f.value, false))
+		} else {
+			clause = "fold(c.sheet) = ?"
+			args = append(args, foldText(f.value))
+		}
+
+	case FILTER_ROW:
+		var conditions []string
+		if f.rowFrom > 0 {
+			conditions = append(conditions, "c.row >= ?")
+			args = append(args, f.rowFrom)
+		}
+		if f.rowTo > 0 {
+			conditions = append(conditions, "c.row <= ?")
+			args = append(args, f.rowTo)
+		}
+		clause = strings.Join(conditions, " AND ")
+
+	case FILTER_COLUMN:
+		clause = "cell_match(coalesce(c.cells, '[]'), coalesce(h.headers, '[]'), ?, ?, ?, ?)"
+		args = append(args, f.column, strings.Join(f.words, " "), f.prefix, f.exact)
+
+	case FILTER_DIRECTORIES:
+		var conditions []string
+		for _, dir := range f.values {
+			conditions = append(conditions, `fold(replace(c.file, '\', '/')) LIKE ? ESCAPE '\'`)
+			args = append(args, likeEscape(dir)+"/%")
+		}
+		clause = "(" + strings.Join(conditions, " OR ") + ")"
+
+	case FILTER_EXTENSIONS:
+		var conditions []string
+		for _, ext := range f.values {
+			conditions = append(conditions, `lower(c.file) LIKE ? ESCAPE '\'`)
+			args = append(args, "%."+likeEscape(ext))
+		}
+		clause = "(" + strings.Join(conditions, " OR ") + ")"
+
+	case FILTER_EMAIL:
+		value := strings.ToLower(strings.TrimPrefix(f.value, "@"))
+		switch {
+		case strings.Contains(value, "@") && emailOnly:
+			clause = "lower(c.email) = ?"
+			args = append(args, value)
+		case strings.Contains(value, "@"):
+			clause = `c.content LIKE ? ESCAPE '\'`
+			args = append(args, "%"+likeEscape(value)+"%")
+		case emailOnly:
+			// The domain itself or any of its subdomains
+			clause = `(lower(c.email) LIKE ? ESCAPE '\' OR lower(c.email) LIKE ? ESCAPE '\')`
+			args = append(args, "%@"+likeEscape(value), "%@%."+likeEscape(value))
+		default:
+			clause = `c.content LIKE ? ESCAPE '\'`
+			args = append(args, "%@%"+likeEscape(value)+"%")
+		}
+	}
+
+	if f.negate {
+		clause = "NOT (" + clause + ")"
+	}
+	return clause, args
+}
+
+func hasGlob(value string) bool {
+	return strings.ContainsAny(value, "*?[")
+}
+
+// globPattern folds a user glob for matching against folded values. Without
+// wildcards a value matches anywhere when contains is set.
+func globPattern(value string, contains bool) string {
+	pattern := foldText(value)
+	if contains && !hasGlob(pattern) {
+		pattern = "*" + pattern + "*"
+	}
+	return pattern
+}
+
+func likeEscape(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return replacer.Replace(value)
+}
+
+// hasPositiveFilter reports whether any filter selects rows rather than
+// excluding them.
+func hasPositiveFilter(filters []searchFilter) bool {
+	for _, filter := range filters {
+		if !filter.negate {
+			return true
+		}
+	}
+	return false
+}
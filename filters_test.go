@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestColumnFilters(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir)
+
+	path := filepath.Join(dir, "customers.csv")
+	content := "Name,Phone,Company Name,Note\n" +
+		"Nguyễn Văn An,0903 123 456,Acme Corp,call back\n" +
+		"Trần Bình,0912 000 111,Globex,acme reseller\n" +
+		"Lê Cường,,Initech Acme,\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := importToSQLite(context.Background(), store, ImportRequest{Files: []string{path}, Extensions: []string{"csv"}}, nil, importProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		rows  []int
+	}{
+		{"Phone:0903", []int{2}},
+		{"Phone:09", []int{2, 3}},
+		{`Phone:"000 111"`, []int{3}},
+		{"Name:nguyen", []int{2}},
+		{`"Company Name":acme`, []int{2, 4}},
+		{`"company name":ACME`, []int{2, 4}},
+		{`"Company Name":acme corp`, []int{2}},
+		{"Note:acme", []int{3}},
+		{"acme -Phone:0903", []int{3, 4}},
+		{"Missing:acme", nil},
+	}
+
+	for _, test := range tests {
+		matches, _, err := searchInSQLite(store, SearchRequest{Query: test.query, Page: 1, PageSize: 10, OrderBy: ORDER_BY_ROW})
+		if err != nil {
+			t.Errorf("search %q: %v", test.query, err)
+			continue
+		}
+		var rows []int
+		for _, match := range matches {
+			rows = append(rows, match.Row)
+		}
+		if !reflect.DeepEqual(rows, test.rows) {
+			t.Errorf("search %q found rows %v; want %v", test.query, rows, test.rows)
+		}
+	}
+
+	matches, _, err := searchInSQLite(store, SearchRequest{Query: "Phone:0903", Page: 1, PageSize: 10})
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("search Phone:0903 = %v, %v; want one match", matches, err)
+	}
+	want := map[string]string{"Name": "Nguyễn Văn An", "Phone": "0903 123 456", "Company Name": "Acme Corp", "Note": "call back"}
+	if !reflect.DeepEqual(matches[0].Fields, want) {
+		t.Errorf("fields %v; want %v", matches[0].Fields, want)
+	}
+}
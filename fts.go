@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SQLITE_DRIVER is the database/sql driver name used for both finder
+// databases. It is the regular go-sqlite3 driver with the extra SQL
+// functions below registered on every connection.
+const SQLITE_DRIVER = "sqlite3_finder"
+
+// Parameters for the bm25 ranking function.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var registerDriverOnce sync.Once
+
+// nativeEndian is the byte order of the host, in which matchinfo writes its
+// integers.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func registerSQLiteDriver() {
+	registerDriverOnce.Do(func() {
+		sql.Register(SQLITE_DRIVER, &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				if err := conn.RegisterFunc("bm25", bm25, true); err != nil {
+					return fmt.Errorf("error registering bm25: %v", err)
+				}
+				if err := conn.RegisterFunc("fold", foldText, true); err != nil {
+					return fmt.Errorf("error registering fold: %v", err)
+				}
+				if err := conn.RegisterFunc("cell_match", cellMatch, true); err != nil {
+					return fmt.Errorf("error registering cell_match: %v", err)
+				}
+				return nil
+			},
+		})
+	})
+}
+
+// bm25 computes an Okapi BM25 relevance score from the blob returned by
+// matchinfo(table, 'pcnalx'). Optional weights are applied per column in
+// table order; columns without a weight count as 1. Higher is better. A
+// blob not laid out as 'pcnalx' describes is an error.
+func bm25(matchinfo []byte, weights ...float64) (float64, error) {
+	if len(matchinfo) < 12 || len(matchinfo)%4 != 0 {
+		return 0, fmt.Errorf("bm25: malformed matchinfo of %d bytes", len(matchinfo))
+	}
+
+	info := make([]uint32, len(matchinfo)/4)
+	for i := range info {
+		info[i] = nativeEndian.Uint32(matchinfo[i*4:])
+	}
+
+	phrases := int(info[0])
+	columns := int(info[1])
+	if len(info) < 3+2*columns || phrases > len(info) || len(info)-3-2*columns != 3*phrases*columns {
+		return 0, fmt.Errorf("bm25: matchinfo of %d values does not fit %d phrases in %d columns", len(info), phrases, columns)
+	}
+	totalDocs := float64(info[2])
+	avgLengths := info[3 : 3+columns]
+	docLengths := info[3+columns : 3+2*columns]
+	hits := info[3+2*columns:]
+
+	score := 0.0
+	for i := 0; i < phrases; i++ {
+		for j := 0; j < columns; j++ {
+			weight := 1.0
+			if j < len(weights) {
+				weight = weights[j]
+			}
+			if weight == 0 {
+				continue
+			}
+
+			x := 3 * (j + i*columns)
+			termFreq := float64(hits[x])
+			docsWithHits := float64(hits[x+2])
+			if termFreq == 0 {
+				continue
+			}
+
+			idf := math.Log((totalDocs - docsWithHits + 0.5) / (docsWithHits + 0.5))
+			if idf <= 0 {
+				idf = 1e-6
+			}
+
+			avgLength := float64(avgLengths[j])
+			if avgLength == 0 {
+				avgLength = 1
+			}
+			lengthNorm := 1 - bm25B + bm25B*float64(docLengths[j])/avgLength
+			score += weight * idf * termFreq * (bm25K1 + 1) / (termFreq + bm25K1*lengthNorm)
+		}
+	}
+	return score, nil
+}
+
+// foldText lowercases text and strips accents so that "Nguyễn", "NGUYEN" and
+// "nguyen" compare equal. Vietnamese đ/Đ have no Unicode decomposition and
+// are mapped to d explicitly.
+func foldText(text string) string {
+	ascii := true
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return strings.ToLower(text)
+	}
+
+	var b strings.Builder
+	b.Grow(len(text))
+	for _, r := range norm.NFD.String(text) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case r == 'đ' || r == 'Đ':
+			r = 'd'
+		default:
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// ftsTokens splits text the way the FTS tokenizer does: runs of letters and
+// digits are tokens, everything else separates them.
+func ftsTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// dropFTSIfOutdated drops an FTS table whose definition lacks column, so
+// that it is recreated with the current columns and tokenizer.
+func dropFTSIfOutdated(database querier, ftsTable, column string) error {
+	var tableSQL string
+	err := database.QueryRow(`
+		SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?
+	`, ftsTable).Scan(&tableSQL)
+	if err == sql.ErrNoRows || strings.Contains(tableSQL, column) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking table %s: %v", ftsTable, err)
+	}
+
+	if _, err := database.Exec("DROP TABLE " + ftsTable); err != nil {
+		return fmt.Errorf("error dropping outdated %s: %v", ftsTable, err)
+	}
+	return nil
+}
+
+// rebuildFTSIfNeeded repopulates an FTS table from its content table when the
+// insert trigger is missing or does not contain marker, i.e. it was written
+// by an older version. Older databases let the FTS table pick its own docids
+// and did not index folded text, so their rows cannot be searched until they
+// are rebuilt.
+func rebuildFTSIfNeeded(database querier, trigger, marker, ftsTable, rebuild string) error {
+	var triggerSQL string
+	err := database.QueryRow(`
+		SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = ?
+	`, trigger).Scan(&triggerSQL)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error checking trigger %s: %v", trigger, err)
+	}
+	if strings.Contains(triggerSQL, marker) {
+		return nil
+	}
+
+	_, err = database.Exec("DELETE FROM " + ftsTable + "; " + rebuild)
+	if err != nil {
+		return fmt.Errorf("error rebuilding %s: %v", ftsTable, err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// matchinfoBlob encodes values as matchinfo does, in the host byte order.
+func matchinfoBlob(values ...uint32) []byte {
+	blob := make([]byte, 4*len(values))
+	for i, v := range values {
+		nativeEndian.PutUint32(blob[4*i:], v)
+	}
+	return blob
+}
+
+func TestBM25(t *testing.T) {
+	// One phrase in two columns of 10 rows: p, c, n, a[2], l[2], x[3*2]
+	valid := matchinfoBlob(1, 2, 10, 4, 6, 3, 5, 2, 2, 3, 0, 0, 0)
+
+	score, err := bm25(valid)
+	if err != nil || score <= 0 {
+		t.Fatalf("bm25(valid) = %v, %v; want a positive score", score, err)
+	}
+	weighted, err := bm25(valid, 0, 1)
+	if err != nil || weighted != 0 {
+		t.Errorf("bm25 with the hit column weighted 0 = %v, %v; want 0", weighted, err)
+	}
+
+	malformed := []struct {
+		name string
+		blob []byte
+	}{
+		{"empty", nil},
+		{"not whole integers", valid[:len(valid)-1]},
+		{"too short", matchinfoBlob(1, 2, 10)},
+		{"columns beyond the blob", matchinfoBlob(1, 1000, 10, 4, 6)},
+		{"missing hits", matchinfoBlob(1, 2, 10, 4, 6, 3, 5, 2, 2, 3)},
+		{"extra hits", matchinfoBlob(1, 2, 10, 4, 6, 3, 5, 2, 2, 3, 0, 0, 0, 1)},
+		{"huge phrase count", matchinfoBlob(1<<31, 1<<31, 10)},
+	}
+	for _, test := range malformed {
+		if _, err := bm25(test.blob); err == nil {
+			t.Errorf("bm25(%s) succeeded; want an error", test.name)
+		}
+	}
+}
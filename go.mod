@@ -3,14 +3,16 @@ module read-excel
 go 1.20
 
 require (
+	github.com/extrame/xls v0.0.1
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/kardianos/service v1.2.2
 	github.com/mattn/go-sqlite3 v1.14.28
 	github.com/xuri/excelize/v2 v2.7.0
+	golang.org/x/text v0.12.0
 )
 
 require (
 	github.com/extrame/ole2 v0.0.0-20160812065207-d69429661ad7 // indirect
-	github.com/extrame/xls v0.0.1 // indirect
 	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
 	github.com/richardlehane/mscfb v1.0.4 // indirect
 	github.com/richardlehane/msoleps v1.0.3 // indirect
@@ -19,6 +21,5 @@ require (
 	github.com/xuri/nfp v0.0.0-20230819163627-dc951e3ffe1a // indirect
 	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/net v0.14.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
-	golang.org/x/text v0.12.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
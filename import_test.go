@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestImportModes(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir)
+	a := filepath.Join(dir, "a.csv")
+	b := filepath.Join(dir, "b.csv")
+	c := filepath.Join(dir, "c.csv")
+	writeTestFile(t, a, "Name\nAn\nBình\n")
+	writeTestFile(t, b, "Name\nCúc\n")
+
+	rowCount := func(path string) int {
+		var n int
+		if err := store.db.QueryRow("SELECT COUNT(*) FROM files_content WHERE file = ?", path).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	check := func(step string, run *ImportRun, inserted, skipped, failed int, rows map[string]int) {
+		t.Helper()
+		if run.RowsInserted != inserted || run.FilesSkipped != skipped || run.FilesFailed != failed {
+			t.Errorf("%s: %d rows inserted, %d files skipped, %d failed; want %d, %d, %d",
+				step, run.RowsInserted, run.FilesSkipped, run.FilesFailed, inserted, skipped, failed)
+		}
+		for path, want := range rows {
+			if got := rowCount(path); got != want {
+				t.Errorf("%s: %s has %d rows; want %d", step, filepath.Base(path), got, want)
+			}
+		}
+	}
+
+	run := importTestFiles(t, store, IMPORT_INCREMENTAL, a, b)
+	check("first import", run, 3, 0, 0, map[string]int{a: 2, b: 1})
+
+	run = importTestFiles(t, store, IMPORT_INCREMENTAL, a, b)
+	check("unchanged", run, 0, 2, 0, map[string]int{a: 2, b: 1})
+
+	// A modified file is replaced, a touched one is still skipped
+	writeTestFile(t, a, "Name\nAn\nBình\nDũng\n")
+	touched := time.Now().Add(time.Hour)
+	if err := os.Chtimes(b, touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	run = importTestFiles(t, store, "", a, b)
+	check("modified and touched", run, 3, 1, 0, map[string]int{a: 3, b: 1})
+
+	run = importTestFiles(t, store, IMPORT_REPLACE, a, b)
+	check("replace", run, 4, 0, 0, map[string]int{a: 3, b: 1})
+
+	run = importTestFiles(t, store, IMPORT_APPEND, a)
+	check("append", run, 3, 0, 0, map[string]int{a: 6, b: 1})
+	if record, err := lookupFile(store.db, a); err != nil || record == nil || record.RowCount != 6 {
+		t.Errorf("registered %+v, %v after append; want 6 rows", record, err)
+	}
+
+	writeTestFile(t, c, "Name\nEm\n")
+	run = importTestFiles(t, store, IMPORT_SKIP_IF_PRESENT, a, b, c)
+	check("skip if present", run, 1, 2, 0, map[string]int{a: 6, b: 1, c: 1})
+
+	// A deleted file fails to import and keeps its rows until it is removed
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	run = importTestFiles(t, store, IMPORT_INCREMENTAL, a, b, c)
+	check("deleted", run, 0, 2, 1, map[string]int{a: 6, b: 1, c: 1})
+	if record, err := lookupFile(store.db, b); err != nil || record == nil || record.Status != FILE_FAILED {
+		t.Errorf("registered %+v, %v after deletion; want a failed import", record, err)
+	}
+
+	removed, err := removeMissingFiles(context.Background(), store, false, dir)
+	if err != nil || removed != 1 {
+		t.Errorf("removeMissingFiles = %d, %v; want 1", removed, err)
+	}
+	check("removed", run, 0, 2, 1, map[string]int{a: 6, b: 0, c: 1})
+	if record, err := lookupFile(store.db, b); err != nil || record != nil {
+		t.Errorf("registered %+v, %v after removal; want no record", record, err)
+	}
+}
+
+func TestImportRowNumbers(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir)
+
+	// Rows are numbered within each sheet, counting the header and blank
+	// rows, as the spreadsheet shows them
+	book := excelize.NewFile()
+	book.SetSheetRow("Sheet1", "A1", &[]interface{}{"Name", "Company"})
+	book.SetSheetRow("Sheet1", "A2", &[]interface{}{"An", "Acme"})
+	book.SetSheetRow("Sheet1", "A3", &[]interface{}{"Bình", "Initech"})
+	book.SetSheetRow("Sheet1", "A4", &[]interface{}{"Cúc", "Umbrella"})
+	if _, err := book.NewSheet("Orders"); err != nil {
+		t.Fatal(err)
+	}
+	book.SetSheetRow("Orders", "A1", &[]interface{}{"Order", "Customer"})
+	book.SetSheetRow("Orders", "A3", &[]interface{}{"O-1", "Globex"})
+	xlsx := filepath.Join(dir, "book.xlsx")
+	if err := book.SaveAs(xlsx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A CSV file is one sheet whose first line is the header
+	csv := filepath.Join(dir, "people.csv")
+	writeTestFile(t, csv, "Name,City\nDũng,Huế\nEm,Hà Nội\n")
+
+	req := ImportRequest{Files: []string{xlsx, csv}, Extensions: []string{"xlsx", "csv"}}
+	if err := importToSQLite(context.Background(), store, req, nil, importProgress{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		file   string
+		sheet  string
+		row    int
+		column string
+	}{
+		{"initech", xlsx, "Sheet1", 3, "B"},
+		{"globex", xlsx, "Orders", 3, "B"},
+		{"O-1", xlsx, "Orders", 3, "A"},
+		{"dung", csv, "Sheet1", 2, "A"},
+		{"ha noi", csv, "Sheet1", 3, "B"},
+	}
+	for _, test := range tests {
+		matches, _, err := searchInSQLite(store, SearchRequest{Query: test.query, Page: 1, PageSize: 10})
+		if err != nil {
+			t.Errorf("search %q: %v", test.query, err)
+			continue
+		}
+		if len(matches) != 1 {
+			t.Errorf("search %q found %d rows; want 1", test.query, len(matches))
+			continue
+		}
+		m := matches[0]
+		if m.File != test.file || m.Sheet != test.sheet || m.Row != test.row || m.Column != test.column {
+			t.Errorf("search %q found %s %s row %d column %s; want %s %s row %d column %s", test.query,
+				filepath.Base(m.File), m.Sheet, m.Row, m.Column, filepath.Base(test.file), test.sheet, test.row, test.column)
+		}
+	}
+}
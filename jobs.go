@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Import job kinds
+const (
+	JOB_IMPORT   = "import"
+	JOB_REIMPORT = "reimport"
+)
+
+// Import job states. Jobs run one at a time and wait as queued until the
+// previous one finishes.
+const (
+	JOB_QUEUED    = "queued"
+	JOB_RUNNING   = "running"
+	JOB_COMPLETED = "completed"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+)
+
+// MAX_FINISHED_JOBS is how many finished jobs are kept for GET /jobs.
+const MAX_FINISHED_JOBS = 100
+
+// Job reports the progress of an import running in the background.
+type Job struct {
+	ID           string         `json:"id"`
+	Kind         string         `json:"kind"`
+	Status       string         `json:"status"`
+	EmailOnly    bool           `json:"emailOnly"`
+	Schedule     string         `json:"schedule,omitempty"`
+	FilesTotal   int            `json:"filesTotal"`
+	FilesDone    int            `json:"filesDone"`
+	FilesFailed  int            `json:"filesFailed"`
+	FilesSkipped int            `json:"filesSkipped"`
+	RowsInserted int            `json:"rowsInserted"`
+	RowsSkipped  int            `json:"rowsSkipped"` // unreadable rows, listed in the file events
+	Errors       []JobFileError `json:"errors"`
+	// SkippedPaths lists what could not be crawled under ImportRequest.Roots
+	SkippedPaths []SkippedPath `json:"skippedPaths"`
+	Message      string        `json:"message,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	StartedAt    *time.Time    `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time    `json:"finishedAt,omitempty"`
+	// ElapsedSeconds counts from the start of the import, ETASeconds is
+	// estimated from the average time per file so far
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	ETASeconds     float64 `json:"etaSeconds,omitempty"`
+}
+
+type JobFileError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// JobFileEvent is sent on a job's event stream as each file finishes.
+type JobFileEvent struct {
+	Path      string `json:"path"`
+	Rows      int    `json:"rows"`
+	Skipped   bool   `json:"skipped,omitempty"` // left alone by the import mode
+	Error     string `json:"error,omitempty"`
+	ElapsedMs int64  `json:"elapsedMs"`
+	// RowsSkipped counts the rows that could not be read; RowErrors has the
+	// first MAX_ROW_ERRORS of them with their line and reason
+	RowsSkipped int        `json:"rowsSkipped,omitempty"`
+	RowErrors   []RowError `json:"rowErrors,omitempty"`
+	// Progress of the job after this file
+	FilesDone    int `json:"filesDone"`
+	FilesTotal   int `json:"filesTotal"`
+	RowsInserted int `json:"rowsInserted"`
+}
+
+type jobEntry struct {
+	mu     sync.Mutex
+	job    Job
+	cancel context.CancelFunc
+
+	// files records every finished file for the event stream, and changed is
+	// closed and replaced whenever the job is updated to wake up listeners.
+	// Once the job has finished and no stream follows it, only the failed
+	// files are kept.
+	files     []JobFileEvent
+	changed   chan struct{}
+	listeners int
+}
+
+// notifyLocked wakes up the event streams of the job.
+func (e *jobEntry) notifyLocked() {
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// trimLocked forgets the files of a finished job that did not fail, which
+// the job's counts already sum up, so that finished jobs hold little
+// memory.
+func (e *jobEntry) trimLocked() {
+	if e.job.FinishedAt == nil || e.listeners > 0 {
+		return
+	}
+	failed := e.files[:0]
+	for _, file := range e.files {
+		if file.Error != "" {
+			failed = append(failed, file)
+		}
+	}
+	for i := len(failed); i < len(e.files); i++ {
+		e.files[i] = JobFileEvent{}
+	}
+	e.files = failed
+}
+
+// snapshot returns a copy of the job with its elapsed time and ETA filled in.
+func (e *jobEntry) snapshot() Job {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	job := e.job
+	job.Errors = append([]JobFileError{}, e.job.Errors...)
+	job.SkippedPaths = append([]SkippedPath{}, e.job.SkippedPaths...)
+	if job.StartedAt != nil {
+		end := time.Now()
+		if job.FinishedAt != nil {
+			end = *job.FinishedAt
+		}
+		elapsed := end.Sub(*job.StartedAt)
+		job.ElapsedSeconds = elapsed.Seconds()
+		if job.Status == JOB_RUNNING && job.FilesDone > 0 && job.FilesTotal > job.FilesDone {
+			perFile := elapsed / time.Duration(job.FilesDone)
+			job.ETASeconds = (perFile * time.Duration(job.FilesTotal-job.FilesDone)).Seconds()
+		}
+	}
+	return job
+}
+
+// jobManager keeps track of import jobs and runs them one at a time.
+type jobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*jobEntry
+	order   []string
+	slot    chan struct{}
+	running sync.WaitGroup
+	// stopping is set once the service stops; no job is started after it
+	stopping bool
+}
+
+var jobQueue = newJobManager()
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		jobs: make(map[string]*jobEntry),
+		slot: make(chan struct{}, 1),
+	}
+}
+
+// start queues an import of req into store and returns the new job right
+// away.
+func (m *jobManager) start(store *Store, kind string, req ImportRequest) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &jobEntry{
+		job: Job{
+			ID:           id,
+			Kind:         kind,
+			Status:       JOB_QUEUED,
+			EmailOnly:    req.EmailOnly,
+			Schedule:     req.Schedule,
+			FilesTotal:   len(importJobs(req.Files, req.Extensions)),
+			Errors:       []JobFileError{},
+			SkippedPaths: []SkippedPath{},
+			CreatedAt:    time.Now(),
+		},
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if m.stopping {
+		m.mu.Unlock()
+		cancel()
+		return Job{}, fmt.Errorf("the service is stopping")
+	}
+	m.jobs[id] = entry
+	m.order = append(m.order, id)
+	m.pruneLocked()
+	m.running.Add(1)
+	m.mu.Unlock()
+
+	go m.run(ctx, store, entry, req)
+	return entry.snapshot(), nil
+}
+
+func (m *jobManager) run(ctx context.Context, store *Store, entry *jobEntry, req ImportRequest) {
+	defer m.running.Done()
+	defer entry.cancel()
+
+	select {
+	case m.slot <- struct{}{}:
+		defer func() { <-m.slot }()
+	case <-ctx.Done():
+		m.finish(entry, ctx.Err())
+		return
+	}
+
+	entry.mu.Lock()
+	now := time.Now()
+	entry.job.Status = JOB_RUNNING
+	entry.job.StartedAt = &now
+	id := entry.job.ID
+	entry.notifyLocked()
+	entry.mu.Unlock()
+
+	log.Printf("Job %s started: %s of %d files and %d roots, emailOnly=%v", id, entry.job.Kind, len(req.Files), len(req.Roots), req.EmailOnly)
+	run := &ImportRun{JobID: id, Kind: entry.job.Kind, Schedule: req.Schedule}
+	err := importToSQLite(ctx, store, req, run, importProgress{
+		planned: func(files int, skipped []SkippedPath) {
+			entry.mu.Lock()
+			defer entry.mu.Unlock()
+			entry.job.FilesTotal = files
+			entry.job.SkippedPaths = append(entry.job.SkippedPaths, skipped...)
+			entry.notifyLocked()
+		},
+		file: func(result ImportResult) {
+			entry.mu.Lock()
+			defer entry.mu.Unlock()
+			event := JobFileEvent{
+				Path:      result.Path,
+				ElapsedMs: result.Elapsed.Milliseconds(),
+			}
+			entry.job.FilesDone++
+			if result.Err != nil {
+				entry.job.FilesFailed++
+				entry.job.Errors = append(entry.job.Errors, JobFileError{
+					File:  result.Path,
+					Error: result.Err.Error(),
+				})
+				event.Error = result.Err.Error()
+			} else if result.Skipped {
+				entry.job.FilesSkipped++
+				event.Skipped = true
+			} else {
+				entry.job.RowsInserted += result.Rows
+				entry.job.RowsSkipped += result.RowsSkipped
+				event.Rows = result.Rows
+				event.RowsSkipped = result.RowsSkipped
+				event.RowErrors = result.RowErrors
+			}
+			event.FilesDone = entry.job.FilesDone
+			event.FilesTotal = entry.job.FilesTotal
+			event.RowsInserted = entry.job.RowsInserted
+			entry.files = append(entry.files, event)
+			entry.notifyLocked()
+		},
+	})
+	m.finish(entry, err)
+}
+
+func (m *jobManager) finish(entry *jobEntry, err error) {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	now := time.Now()
+	entry.job.FinishedAt = &now
+	entry.job.Status, entry.job.Message = importOutcome(err, entry.job.RowsInserted, entry.job.FilesDone, entry.job.FilesSkipped)
+	log.Printf("Job %s %s: %s", entry.job.ID, entry.job.Status, entry.job.Message)
+	entry.trimLocked()
+	entry.notifyLocked()
+}
+
+// importOutcome returns the job status and message for an import that
+// ended with err.
+func importOutcome(err error, rows, files, skipped int) (string, string) {
+	switch {
+	case err == context.Canceled:
+		return JOB_CANCELLED, "Import cancelled"
+	case err != nil:
+		return JOB_FAILED, err.Error()
+	}
+	message := fmt.Sprintf("Imported %d rows from %d files", rows, files-skipped)
+	if skipped > 0 {
+		message += fmt.Sprintf(", %d files skipped", skipped)
+	}
+	return JOB_COMPLETED, message
+}
+
+// pruneLocked forgets the oldest finished jobs beyond MAX_FINISHED_JOBS.
+func (m *jobManager) pruneLocked() {
+	finished := 0
+	for i := len(m.order) - 1; i >= 0; i-- {
+		entry := m.jobs[m.order[i]]
+		entry.mu.Lock()
+		done := entry.job.FinishedAt != nil
+		entry.mu.Unlock()
+		if !done {
+			continue
+		}
+		finished++
+		if finished > MAX_FINISHED_JOBS {
+			delete(m.jobs, m.order[i])
+			m.order = append(m.order[:i], m.order[i+1:]...)
+		}
+	}
+}
+
+func (m *jobManager) get(id string) (*jobEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.jobs[id]
+	return entry, ok
+}
+
+// list returns every known job, newest first.
+func (m *jobManager) list() []Job {
+	m.mu.Lock()
+	entries := make([]*jobEntry, 0, len(m.order))
+	for _, id := range m.order {
+		entries = append(entries, m.jobs[id])
+	}
+	m.mu.Unlock()
+
+	jobs := make([]Job, 0, len(entries))
+	for _, entry := range entries {
+		jobs = append(jobs, entry.snapshot())
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// stop refuses new jobs and cancels every queued and running job, when the
+// service stops.
+func (m *jobManager) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopping = true
+	for _, entry := range m.jobs {
+		entry.cancel()
+	}
+}
+
+// wait returns once every job has finished.
+func (m *jobManager) wait() {
+	m.running.Wait()
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating job id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// jobsHandler serves GET /jobs, GET /jobs/{id}, DELETE /jobs/{id}, which
+// cancels a queued or running job, and GET /jobs/{id}/events. A cancelled
+// job keeps the files it had already imported.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	id, sub, _ := strings.Cut(path, "/")
+
+	if id == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobQueue.list())
+		return
+	}
+
+	entry, ok := jobQueue.get(id)
+	if !ok || (sub != "" && sub != "events") {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if sub == "events" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		streamJobEvents(w, r, entry)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		log.Printf("Cancelling job %s", id)
+		entry.cancel()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry.snapshot())
+}
+
+// streamJobEvents sends the progress of a job as Server-Sent Events: a "job"
+// event with the job as it is when the stream opens, a "file" event for every
+// file finished so far and then as each one finishes, and a "done" event with
+// the final job, after which the stream ends. A stream opened after the job
+// finished only replays its failed files.
+func streamJobEvents(w http.ResponseWriter, r *http.Request, entry *jobEntry) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The files are kept for as long as the stream follows the job
+	entry.mu.Lock()
+	entry.listeners++
+	entry.mu.Unlock()
+	defer func() {
+		entry.mu.Lock()
+		entry.listeners--
+		entry.trimLocked()
+		entry.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	if err := writeEvent(w, "job", entry.snapshot()); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	sent := 0
+	for {
+		entry.mu.Lock()
+		files := entry.files[sent:]
+		finished := entry.job.FinishedAt != nil
+		changed := entry.changed
+		entry.mu.Unlock()
+
+		for _, file := range files {
+			if err := writeEvent(w, "file", file); err != nil {
+				return
+			}
+		}
+		sent += len(files)
+
+		if finished {
+			writeEvent(w, "done", entry.snapshot())
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFinishedJobKeepsFailedFiles(t *testing.T) {
+	entry := &jobEntry{
+		job:     Job{ID: "test", Errors: []JobFileError{}},
+		cancel:  func() {},
+		changed: make(chan struct{}),
+	}
+	entry.files = []JobFileEvent{
+		{Path: "a.csv", Rows: 10, RowErrors: []RowError{{Line: 3, Reason: "bad quote"}}},
+		{Path: "b.csv", Error: "unreadable"},
+		{Path: "c.csv", Skipped: true},
+	}
+
+	// A stream following the job keeps every file until it ends
+	entry.mu.Lock()
+	entry.listeners++
+	entry.mu.Unlock()
+	newJobManager().finish(entry, errors.New("1 file failed"))
+	if len(entry.files) != 3 {
+		t.Fatalf("%d files kept while a stream follows the job; want 3", len(entry.files))
+	}
+
+	entry.mu.Lock()
+	entry.listeners--
+	entry.trimLocked()
+	entry.mu.Unlock()
+	if len(entry.files) != 1 || entry.files[0].Path != "b.csv" {
+		t.Fatalf("files %+v kept; want the failed b.csv", entry.files)
+	}
+
+	recorder := httptest.NewRecorder()
+	streamJobEvents(recorder, httptest.NewRequest("GET", "/jobs/test/events", nil), entry)
+	body := recorder.Body.String()
+	if strings.Count(body, "event: file") != 1 || !strings.Contains(body, `"path":"b.csv"`) || !strings.Contains(body, "event: done") {
+		t.Errorf("stream of the finished job:\n%s\nwant the failed file and the done event", body)
+	}
+	if entry.listeners != 0 {
+		t.Errorf("%d listeners after the stream ended; want 0", entry.listeners)
+	}
+}
+
+func TestStoppedJobManagerRefusesJobs(t *testing.T) {
+	m := newJobManager()
+	m.stop()
+	if _, err := m.start(nil, JOB_IMPORT, ImportRequest{}); err == nil {
+		t.Error("started a job after stop; want an error")
+	}
+	done := make(chan struct{})
+	go func() {
+		m.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("wait did not return with no job running")
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -22,11 +22,23 @@ import (
 	"github.com/xuri/excelize/v2"
 )
 
+// File names of the databases in Config.DataDir
 const (
 	DB_PATH       = "finder.db"
 	EMAIL_DB_PATH = "finder-email.db"
 )
 
+// MAX_ROW_ERRORS is how many unreadable rows are reported for each file.
+const MAX_ROW_ERRORS = 100
+
+// Rows are read from a file ROW_BATCH_SIZE at a time. The first
+// ROW_BATCHES_IN_MEMORY batches of a file are kept in memory until they are
+// written, and later ones are spooled to a temporary file
+const (
+	ROW_BATCH_SIZE        = 1000
+	ROW_BATCHES_IN_MEMORY = 4
+)
+
 type SearchRequest struct {
 	Directories []string `json:"directories"`
 	Query       string   `json:"query"`
@@ -34,13 +46,79 @@ type SearchRequest struct {
 	Page        int      `json:"page"`
 	PageSize    int      `json:"pageSize"`
 	EmailOnly   bool     `json:"emailOnly"`
+	OrderBy     string   `json:"orderBy"`
+	// ExactAccents disables accent folding, so "nguyen" no longer matches "Nguyễn"
+	ExactAccents bool          `json:"exactAccents"`
+	Filters      SearchFilters `json:"filters"`
+}
+
+// SearchFilters narrows a search the same way the file:, sheet:, row: and
+// email: query qualifiers do. Both are applied when given.
+type SearchFilters struct {
+	File        string `json:"file"`        // path glob, e.g. D:\2023\*; plain text matches anywhere in the path
+	Sheet       string `json:"sheet"`       // sheet name or glob
+	RowFrom     int    `json:"rowFrom"`     // first row, inclusive
+	RowTo       int    `json:"rowTo"`       // last row, inclusive
+	EmailDomain string `json:"emailDomain"` // domain (with subdomains) or full address
 }
 
+// Result orderings accepted in SearchRequest.OrderBy
+const (
+	ORDER_BY_ROW  = "row"
+	ORDER_BY_RANK = "rank"
+)
+
 type ImportRequest struct {
 	Files      []string `json:"files"`
 	Extensions []string `json:"extensions"`
 	ResetDB    bool     `json:"resetDB"`
 	EmailOnly  bool     `json:"emailOnly"`
+	// Mode says what to do with files imported before, IMPORT_INCREMENTAL
+	// when empty
+	Mode string `json:"mode"`
+
+	// Roots are directories crawled for files to import besides Files.
+	// Include and Exclude are globs matched against file and directory
+	// names, or against paths relative to the root when they contain a
+	// slash; excluded directories are not entered. MaxDepth limits how many
+	// directory levels are entered, 1 being the files directly in a root and
+	// 0 no limit. Symlinks is SYMLINKS_SKIP (default) or SYMLINKS_FOLLOW.
+	Roots    []string `json:"roots"`
+	Include  []string `json:"include"`
+	Exclude  []string `json:"exclude"`
+	MaxDepth int      `json:"maxDepth"`
+	Symlinks string   `json:"symlinks"`
+
+	// CSV overrides the delimiter, quote and encoding detected in CSV files
+	CSV CSVOptions `json:"csv"`
+
+	// Schedule names the configured schedule that started the import
+	Schedule string `json:"-"`
+}
+
+// Import modes accepted in ImportRequest.Mode
+const (
+	// IMPORT_INCREMENTAL skips files whose size and modification time, or
+	// else content hash, match their last successful import, and replaces
+	// the rows of changed files
+	IMPORT_INCREMENTAL = "incremental"
+	// IMPORT_APPEND inserts the rows of every file, keeping the rows it
+	// already has
+	IMPORT_APPEND = "append"
+	// IMPORT_REPLACE replaces the rows of every file, changed or not
+	IMPORT_REPLACE = "replace"
+	// IMPORT_SKIP_IF_PRESENT only imports files that were never imported
+	// successfully
+	IMPORT_SKIP_IF_PRESENT = "skip-if-present"
+)
+
+// validImportMode reports whether mode is one of the import modes or empty.
+func validImportMode(mode string) bool {
+	switch mode {
+	case "", IMPORT_INCREMENTAL, IMPORT_APPEND, IMPORT_REPLACE, IMPORT_SKIP_IF_PRESENT:
+		return true
+	}
+	return false
 }
 
 type CheckFilesRequest struct {
@@ -51,14 +129,22 @@ type CheckFilesRequest struct {
 type CheckFilesResponse struct {
 	ImportedFiles    []string `json:"importedFiles"`
 	NotImportedFiles []string `json:"notImportedFiles"`
+	// Files has the registry entries of the files that were ever imported
+	Files []FileRecord `json:"files"`
 }
 
 type Match struct {
-	File    string `json:"file"`
-	Sheet   string `json:"sheet"`
-	Row     int    `json:"row"`
-	Email   string `json:"email"`
-	Content string `json:"content"`
+	File  string `json:"file"`
+	Sheet string `json:"sheet"`
+	// Row is the 1-based spreadsheet row and Column the letter of the first
+	// cell containing a search term, when known
+	Row     int     `json:"row"`
+	Column  string  `json:"column,omitempty"`
+	Email   string  `json:"email"`
+	Content string  `json:"content"`
+	Score   float64 `json:"score,omitempty"`
+	// Fields maps column headers to the row's non-blank values
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
 type SearchResponse struct {
@@ -74,6 +160,7 @@ type ImportResponse struct {
 	TotalRows   int    `json:"totalRows"`
 	TotalFiles  int    `json:"totalFiles"`
 	FailedFiles int    `json:"failedFiles"`
+	JobID       string `json:"jobId,omitempty"`
 }
 
 type StatusRequest struct {
@@ -88,11 +175,18 @@ type StatusResponse struct {
 	DBSize      string `json:"dbSize"`
 }
 
-var db *sql.DB
-var emailDB *sql.DB
+// handlers serve the HTTP API from a store.
+type handlers struct {
+	store *Store
+}
 
 type program struct {
+	config *Config
+	store  *Store
 	server *http.Server
+	cancel context.CancelFunc
+	// tasks are the watchers and the scheduler, stopped by cancel
+	tasks sync.WaitGroup
 }
 
 func (p *program) Start(s service.Service) error {
@@ -103,10 +197,25 @@ func (p *program) Start(s service.Service) error {
 
 func (p *program) Stop(s service.Service) error {
 	log.Printf("Service stopping...")
+	// Cancel the jobs and refuse new ones, then wait for the watchers, the
+	// scheduler and the jobs to return before the store is closed
+	if p.cancel != nil {
+		p.cancel()
+	}
+	jobQueue.stop()
+	p.tasks.Wait()
+	jobQueue.wait()
+
+	var err error
 	if p.server != nil {
-		return p.server.Close()
+		err = p.server.Close()
 	}
-	return nil
+	if p.store != nil {
+		if closeErr := p.store.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 func (p *program) run() {
@@ -120,7 +229,10 @@ func (p *program) run() {
 
 	// Print debug information
 	fmt.Printf("Working directory: %s\n", workDir)
-	staticDir := filepath.Join(workDir, "static")
+	staticDir, err := filepath.Abs(p.config.StaticDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Printf("Static directory: %s\n", staticDir)
 
 	// Verify static directory exists
@@ -128,6 +240,16 @@ func (p *program) run() {
 		log.Fatalf("Static directory does not exist: %s", staticDir)
 	}
 
+	// Open the databases, creating or upgrading their tables
+	p.store = newStore(p.config.Database, p.config.EmailDatabase)
+	if err := p.store.Open(); err != nil {
+		log.Fatal(err)
+	}
+	if err := p.store.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+	h := &handlers{store: p.store}
+
 	// Set up static file server with logging
 	fs := http.FileServer(http.Dir(staticDir))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
@@ -145,168 +267,45 @@ func (p *program) run() {
 		}
 	})
 
-	http.HandleFunc("/search", searchHandler)
-	http.HandleFunc("/import", importHandler)
-	http.HandleFunc("/check-files", checkFilesHandler)
-	http.HandleFunc("/status", statusHandler)
+	http.HandleFunc("/search", h.searchHandler)
+	http.HandleFunc("/import", h.importHandler)
+	http.HandleFunc("/reimport", h.reimportHandler)
+	http.HandleFunc("/jobs", jobsHandler)
+	http.HandleFunc("/jobs/", jobsHandler)
+	http.HandleFunc("/imports", h.importsHandler)
+	http.HandleFunc("/schedules", h.schedulesHandler)
+	http.HandleFunc("/files", h.filesHandler)
+	http.HandleFunc("/check-files", h.checkFilesHandler)
+	http.HandleFunc("/status", h.statusHandler)
+
+	// Watch the configured folders and run the scheduled imports until the
+	// service stops
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	startWatchers(ctx, &p.tasks, p.store, p.config.Watch)
+	startScheduler(ctx, &p.tasks, p.store, p.config.Schedules)
 
 	// Create server
 	p.server = &http.Server{
-		Addr: ":8080",
+		Addr: p.config.Addr,
 	}
 
-	log.Printf("Server starting at http://localhost:8080/static/")
-	fmt.Println("Server running at http://localhost:8080/static/")
+	url := "http://" + p.config.Addr + "/static/"
+	if strings.HasPrefix(p.config.Addr, ":") {
+		url = "http://localhost" + p.config.Addr + "/static/"
+	}
+	log.Printf("Server starting at %s", url)
+	fmt.Println("Server running at " + url)
 	if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
 
 func init() {
-	var err error
-	// Open main database with optimized settings
-	db, err = sql.Open("sqlite3", DB_PATH+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)&_pragma=temp_store(MEMORY)&_pragma=mmap_size(30000000000)&_pragma=cache_size(-2000)&_pragma=page_size(4096)")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Open email database with optimized settings
-	emailDB, err = sql.Open("sqlite3", EMAIL_DB_PATH+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)&_pragma=temp_store(MEMORY)&_pragma=mmap_size(30000000000)&_pragma=cache_size(-2000)&_pragma=page_size(4096)")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Set connection pool settings for both databases
-	for _, d := range []*sql.DB{db, emailDB} {
-		d.SetMaxOpenConns(1)
-		d.SetMaxIdleConns(1)
-		d.SetConnMaxLifetime(time.Hour)
-	}
-
-	// Set additional PRAGMAs for optimization for both databases
-	for _, d := range []*sql.DB{db, emailDB} {
-		_, err = d.Exec(`
-			PRAGMA synchronous = NORMAL;
-			PRAGMA journal_mode = WAL;
-			PRAGMA busy_timeout = 5000;
-			PRAGMA temp_store = MEMORY;
-			PRAGMA mmap_size = 30000000000;
-			PRAGMA cache_size = -2000;
-			PRAGMA page_size = 4096;
-			PRAGMA auto_vacuum = INCREMENTAL;
-		`)
-		if err != nil {
-			log.Printf("Warning: Could not set all PRAGMAs: %v", err)
-		}
-	}
-
-	// Create tables for both databases
-	if err := createTable(); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := createEmailTable(); err != nil {
-		log.Fatal(err)
-	}
-
-	// Check initial database sizes
-	log.Printf("Checking initial database sizes")
-	if err := checkDatabaseSize(); err != nil {
-		log.Printf("Warning: Could not check initial database size: %v", err)
-	}
-
-	// Verify initial state
-	log.Printf("Verifying initial table state")
-	if err := verifyTableState(); err != nil {
-		log.Printf("Warning: Could not verify initial table state: %v", err)
-	}
+	registerSQLiteDriver()
 }
 
-func createTable() error {
-	// Create content table with optimized settings
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS files_content (
-			file TEXT,
-			sheet TEXT,
-			row INTEGER,
-			content TEXT
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating content table: %v", err)
-	}
-
-	// Create FTS4 virtual table with optimized settings
-	_, err = db.Exec(`
-		CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts4(
-			file,
-			sheet,
-			row,
-			content,
-			tokenize=simple
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating FTS4 table: %v", err)
-	}
-
-	// Create trigger to maintain FTS4 table
-	_, err = db.Exec(`
-		DROP TRIGGER IF EXISTS files_ai;
-		DROP TRIGGER IF EXISTS files_ad;
-		DROP TRIGGER IF EXISTS files_au;
-		
-		CREATE TRIGGER files_ai AFTER INSERT ON files_content BEGIN
-			INSERT INTO files_fts(file, sheet, row, content)
-			VALUES (new.file, new.sheet, new.row, new.content);
-		END;
-		
-		CREATE TRIGGER files_ad AFTER DELETE ON files_content BEGIN
-			DELETE FROM files_fts 
-			WHERE file = old.file AND sheet = old.sheet AND row = old.row;
-		END;
-		
-		CREATE TRIGGER files_au AFTER UPDATE ON files_content BEGIN
-			DELETE FROM files_fts 
-			WHERE file = old.file AND sheet = old.sheet AND row = old.row;
-			INSERT INTO files_fts(file, sheet, row, content)
-			VALUES (new.file, new.sheet, new.row, new.content);
-		END;
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating triggers: %v", err)
-	}
-
-	return nil
-}
-
-func createEmailTable() error {
-	// Create email content table with optimized settings
-	_, err := emailDB.Exec(`
-		CREATE TABLE IF NOT EXISTS email_content (
-			file TEXT,
-			sheet TEXT,
-			row INTEGER,
-			email TEXT,
-			content TEXT
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating email content table: %v", err)
-	}
-
-	// Create index on email column
-	_, err = emailDB.Exec(`
-		CREATE INDEX IF NOT EXISTS idx_email ON email_content(email)
-	`)
-	if err != nil {
-		return fmt.Errorf("error creating email index: %v", err)
-	}
-
-	return nil
-}
-
-func verifyTableState() error {
+func verifyTableState(db *sql.DB) error {
 	var count int
 	err := db.QueryRow("SELECT COUNT(*) FROM files_content").Scan(&count)
 	if err != nil {
@@ -316,7 +315,7 @@ func verifyTableState() error {
 	return nil
 }
 
-func checkDatabaseSize() error {
+func checkDatabaseSize(db *sql.DB) error {
 	var size int64
 	err := db.QueryRow("SELECT page_count * page_size as size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
 	if err != nil {
@@ -326,13 +325,7 @@ func checkDatabaseSize() error {
 	return nil
 }
 
-func getDatabaseSize(emailOnly bool) (int64, error) {
-	// Select database based on type
-	database := db
-	if emailOnly {
-		database = emailDB
-	}
-
+func getDatabaseSize(database *sql.DB) (int64, error) {
 	var size int64
 	err := database.QueryRow("SELECT page_count * page_size as size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
 	if err != nil {
@@ -344,9 +337,10 @@ func getDatabaseSize(emailOnly bool) (int64, error) {
 type ImportJob struct {
 	Path      string
 	Extension string
+	Options   ReadOptions
 }
 
-func verifyContentIndexing() error {
+func verifyContentIndexing(db *sql.DB) error {
 	// Get a sample row from the content table
 	var content string
 	err := db.QueryRow(`
@@ -381,200 +375,293 @@ func verifyContentIndexing() error {
 	return nil
 }
 
-func readCSVFile(path string) ([]map[string]interface{}, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+// sheetRow is one data row of a spreadsheet, as handed to the database by
+// the file readers.
+type sheetRow struct {
+	// file is the virtual path of the archive member the row was read
+	// from, or the path of the imported file
+	file  string
+	sheet string
+	// row is the spreadsheet row number, counting from 1
+	row     int
+	content string
+	cells   string
+	// headers are the normalized column headers of the sheet
+	headers []string
+	// skipped is set instead of the values of a row that could not be read
+	skipped *RowError
+}
 
-	reader := csv.NewReader(file)
-	rows, err := reader.ReadAll()
-	if err != nil {
-		return nil, err
-	}
+// RowError is a row of a file that could not be read and was skipped.
+type RowError struct {
+	// File is the archive member the row was read from, if any
+	File string `json:"file,omitempty"`
+	// Line is the line of the file the row starts on
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
 
-	if len(rows) == 0 {
-		return nil, fmt.Errorf("empty CSV file")
+// readXLSFile reads the sheets of an XLS workbook, calling emit with every
+// non-empty row after the header row of each sheet. The XLS library loads
+// the whole workbook.
+func readXLSFile(path string, emit func(sheetRow) error) error {
+	// Open XLS file
+	xlFile, err := xls.Open(path, "utf-8")
+	if err != nil {
+		return fmt.Errorf("failed to open XLS file: %v", err)
 	}
 
-	var documents []map[string]interface{}
-
-	for rowNum, row := range rows[1:] {
-		if len(row) == 0 {
+	// Process each sheet
+	for i := 0; i < xlFile.NumSheets(); i++ {
+		sheet := xlFile.GetSheet(i)
+		if sheet == nil {
 			continue
 		}
 
-		// Join all values with a separator
-		content := strings.Join(row, " - ")
-
-		doc := map[string]interface{}{
-			"file":    path,
-			"sheet":   "Sheet1",
-			"row":     rowNum + 2,
-			"content": content,
+		// Get sheet name
+		sheetName := sheet.Name
+		if sheetName == "" {
+			sheetName = fmt.Sprintf("Sheet%d", i+1)
 		}
-		documents = append(documents, doc)
-	}
-	return documents, nil
-}
 
-func readExcelFile(path string) ([]map[string]interface{}, error) {
-	// Check if it's an XLS file
-	if strings.HasSuffix(strings.ToLower(path), ".xls") {
-		// Open XLS file
-		xlFile, err := xls.Open(path, "utf-8")
-		if err != nil {
-			return nil, fmt.Errorf("failed to open XLS file: %v", err)
+		// The first row holds the column headers
+		var headerRow []string
+		if row := sheet.Row(0); row != nil {
+			for colIndex := 0; colIndex < int(row.LastCol()); colIndex++ {
+				headerRow = append(headerRow, row.Col(colIndex))
+			}
 		}
+		headers := normalizeHeaders(headerRow)
 
-		var documents []map[string]interface{}
-		rowNum := 1
-
-		// Process each sheet
-		for i := 0; i < xlFile.NumSheets(); i++ {
-			sheet := xlFile.GetSheet(i)
-			if sheet == nil {
+		// Process each row; MaxRow is the index of the last row
+		for rowIndex := 1; rowIndex <= int(sheet.MaxRow); rowIndex++ {
+			row := sheet.Row(rowIndex)
+			if row == nil {
 				continue
 			}
 
-			// Get sheet name
-			sheetName := sheet.Name
-			if sheetName == "" {
-				sheetName = fmt.Sprintf("Sheet%d", i+1)
-			}
-
-			// Process each row
-			for rowIndex := 1; rowIndex < int(sheet.MaxRow); rowIndex++ {
-				row := sheet.Row(rowIndex)
-				if row == nil {
-					continue
-				}
-
-				// Collect all cell values
-				var colValues []string
-				for colIndex := 0; colIndex < int(row.LastCol()); colIndex++ {
-					cell := row.Col(colIndex)
-					if cell != "" {
-						colValues = append(colValues, cell)
-					}
+			// Collect all cell values
+			var colValues []string
+			cells := make([]string, 0, int(row.LastCol()))
+			for colIndex := 0; colIndex < int(row.LastCol()); colIndex++ {
+				cell := row.Col(colIndex)
+				cells = append(cells, cell)
+				if cell != "" {
+					colValues = append(colValues, cell)
 				}
+			}
+			if len(colValues) == 0 {
+				continue
+			}
 
-				// Join all values with a separator
-				content := strings.Join(colValues, " - ")
-
-				doc := map[string]interface{}{
-					"file":    path,
-					"sheet":   sheetName,
-					"row":     rowNum,
-					"content": content,
-				}
-				documents = append(documents, doc)
-				rowNum++
+			// Join all values with a separator
+			err := emit(sheetRow{
+				sheet:   sheetName,
+				row:     rowIndex + 1,
+				content: strings.Join(colValues, " - "),
+				cells:   encodeCells(cells),
+				headers: headers,
+			})
+			if err != nil {
+				return err
 			}
 		}
-
-		return documents, nil
 	}
 
-	// Handle XLSX files
+	return nil
+}
+
+// readXLSXFile reads the sheets of an XLSX workbook, calling emit with
+// every non-empty row after the header row of each sheet. Sheets are
+// streamed a row at a time.
+func readXLSXFile(path string, emit func(sheetRow) error) error {
 	f, err := excelize.OpenFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open Excel file: %v", err)
+		return fmt.Errorf("failed to open Excel file: %v", err)
 	}
 	defer f.Close()
 
-	var documents []map[string]interface{}
-	rowNum := 1
-
 	for _, sheet := range f.GetSheetList() {
-		rows, err := f.GetRows(sheet)
+		if err := readExcelSheet(f, sheet, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readExcelSheet streams the rows of one XLSX sheet to emit. A sheet that
+// cannot be opened is skipped.
+func readExcelSheet(f *excelize.File, sheet string, emit func(sheetRow) error) error {
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	// The iterator returns blank rows in between as empty slices, so it
+	// counts spreadsheet row numbers
+	var headers []string
+	rowNum := 0
+	for rows.Next() {
+		rowNum++
+		row, err := rows.Columns()
 		if err != nil {
+			return fmt.Errorf("error reading sheet %s: %v", sheet, err)
+		}
+		if rowNum == 1 {
+			headers = normalizeHeaders(row)
 			continue
 		}
-
-		if len(rows) == 0 {
+		if len(row) == 0 {
 			continue
 		}
 
-		for _, row := range rows[1:] {
-			if len(row) == 0 {
-				continue
-			}
+		// Join all values with a separator
+		err = emit(sheetRow{
+			sheet:   sheet,
+			row:     rowNum,
+			content: strings.Join(row, " - "),
+			cells:   encodeCells(row),
+			headers: headers,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := rows.Error(); err != nil {
+		return fmt.Errorf("error reading sheet %s: %v", sheet, err)
+	}
+	return nil
+}
 
-			// Join all values with a separator
-			content := strings.Join(row, " - ")
+// ImportResult is the outcome of importing one file. Skipped is set when the
+// file was left alone by the import mode, e.g. because it did not change.
+type ImportResult struct {
+	Path    string
+	Rows    int
+	Skipped bool
+	// RowsSkipped counts the rows that could not be read; RowErrors has the
+	// first MAX_ROW_ERRORS of them
+	RowsSkipped int
+	RowErrors   []RowError
+	Err         error
+	Elapsed     time.Duration
+}
 
-			doc := map[string]interface{}{
-				"file":    path,
-				"sheet":   sheet,
-				"row":     rowNum,
-				"content": content,
-			}
-			documents = append(documents, doc)
-			rowNum++
+// importJobs returns the files that have one of extensions, in order.
+func importJobs(files []string, extensions []string) []ImportJob {
+	var jobs []ImportJob
+	for _, file := range files {
+		if ext := allowedExtension(file, extensions); ext != "" {
+			jobs = append(jobs, ImportJob{
+				Path:      file,
+				Extension: ext,
+			})
 		}
 	}
-	return documents, nil
+	return jobs
 }
 
-func resetDatabase() error {
-	// Drop existing tables
-	_, err := db.Exec(`
-		DROP TABLE IF EXISTS files_content;
-		DROP TABLE IF EXISTS files_fts;
-	`)
-	if err != nil {
-		return fmt.Errorf("error dropping existing tables: %v", err)
+// allowedExtension returns the extension of file, normalized, when it is one
+// of extensions, and "" otherwise. Extensions are compared ignoring case.
+func allowedExtension(file string, extensions []string) string {
+	ext := normalizeExtension(filepath.Ext(file))
+	if ext == "" {
+		return ""
+	}
+	for _, allowedExt := range extensions {
+		if ext == normalizeExtension(allowedExt) {
+			return ext
+		}
 	}
+	return ""
+}
 
-	// Recreate tables
-	return createTable()
+// importProgress receives the progress of importToSQLite. Either function
+// may be nil.
+type importProgress struct {
+	// planned is called once the files to import are known, with the paths
+	// skipped while crawling the roots
+	planned func(files int, skipped []SkippedPath)
+	// file is called with the result of every file as it finishes
+	file func(ImportResult)
 }
 
-func resetEmailDatabase() error {
-	// Drop existing tables
-	_, err := emailDB.Exec(`
-		DROP TABLE IF EXISTS email_content;
-	`)
-	if err != nil {
-		return fmt.Errorf("error dropping existing email tables: %v", err)
+// planImport returns the files of req to import: its Files and the files
+// found under its Roots, with one of its Extensions and each path once.
+func planImport(ctx context.Context, req ImportRequest) ([]ImportJob, []SkippedPath, error) {
+	files := req.Files
+	var skipped []SkippedPath
+	if len(req.Roots) > 0 {
+		crawled, crawlSkipped, err := crawlRoots(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(append([]string{}, files...), crawled...)
+		skipped = crawlSkipped
 	}
 
-	// Recreate tables
-	return createEmailTable()
+	var jobs []ImportJob
+	seen := make(map[string]bool)
+	for _, job := range importJobs(files, req.Extensions) {
+		if !seen[job.Path] {
+			seen[job.Path] = true
+			job.Options = ReadOptions{CSV: req.CSV}
+			jobs = append(jobs, job)
+		}
+	}
+	if limit := importSettings.MaxFiles; limit > 0 && len(jobs) > limit {
+		return nil, nil, fmt.Errorf("import of %d files exceeds the limit of %d files", len(jobs), limit)
+	}
+	return jobs, skipped, nil
 }
 
-func importToSQLite(files []string, extensions []string, resetDB bool, emailOnly bool) error {
+// importToSQLite imports the request's files with one of its extensions,
+// handling files imported before according to req.Mode, and reports its
+// progress to progress. Cancelling ctx stops the import: files not started
+// are skipped and the file being written is rolled back. The run and each
+// file's outcome are recorded in the imports and files tables; run may be
+// nil and is updated with the outcome.
+func importToSQLite(ctx context.Context, store *Store, req ImportRequest, run *ImportRun, progress importProgress) error {
+	emailOnly := req.EmailOnly
+
 	// Select database based on type
-	database := db
-	if emailOnly {
-		database = emailDB
-	}
+	database := store.database(emailOnly)
 
 	// Reset database if requested
-	if resetDB {
-		if emailOnly {
-			if err := resetEmailDatabase(); err != nil {
-				return fmt.Errorf("error resetting email database: %v", err)
-			}
-		} else {
-			if err := resetDatabase(); err != nil {
-				return fmt.Errorf("error resetting database: %v", err)
-			}
+	if req.ResetDB {
+		if err := store.reset(emailOnly); err != nil {
+			return fmt.Errorf("error resetting database: %v", err)
 		}
 	}
 
+	files, skippedPaths, err := planImport(ctx, req)
+	if err != nil {
+		return err
+	}
+	if progress.planned != nil {
+		progress.planned(len(files), skippedPaths)
+	}
+	for _, skipped := range skippedPaths {
+		log.Printf("Warning: Skipping %s: %s", skipped.Path, skipped.Reason)
+	}
+
+	if run == nil {
+		run = &ImportRun{Kind: JOB_IMPORT}
+	}
+	run.FilesTotal = len(files)
+	if err := beginImportRun(database, run); err != nil {
+		return err
+	}
+
 	// Create a mutex for database access
 	var dbMutex sync.Mutex
 
 	// Create a channel for jobs with larger buffer
 	jobs := make(chan ImportJob, 5000)
-	results := make(chan error, 5000)
-	rowCounts := make(chan int, 5000)
+	results := make(chan ImportResult, 5000)
 
-	// Increase number of workers for better parallelization
-	numWorkers := runtime.NumCPU()
+	numWorkers := importSettings.workers()
 
 	// Start worker goroutines
 	var wg sync.WaitGroup
@@ -583,132 +670,29 @@ func importToSQLite(files []string, extensions []string, resetDB bool, emailOnly
 		go func() {
 			defer wg.Done()
 			for job := range jobs {
-				var docs []map[string]interface{}
-				var err error
-
-				if job.Extension == "csv" {
-					docs, err = readCSVFile(job.Path)
-				} else {
-					docs, err = readExcelFile(job.Path)
-				}
-
-				if err != nil {
-					results <- fmt.Errorf("error reading file %s: %v", job.Path, err)
-					rowCounts <- 0
-					continue
-				}
-
-				// Lock database access
-				dbMutex.Lock()
-
-				// Begin transaction for this batch
-				tx, err := database.Begin()
-				if err != nil {
-					dbMutex.Unlock()
-					results <- fmt.Errorf("error starting transaction for %s: %v", job.Path, err)
-					rowCounts <- 0
-					continue
-				}
-
-				// Prepare statement based on database type
-				var stmt *sql.Stmt
-				if emailOnly {
-					stmt, err = tx.Prepare(`
-						INSERT INTO email_content (file, sheet, row, email, content)
-						VALUES (?, ?, ?, ?, ?)
-					`)
-				} else {
-					stmt, err = tx.Prepare(`
-						INSERT INTO files_content (file, sheet, row, content)
-						VALUES (?, ?, ?, ?)
-					`)
-				}
-
-				if err != nil {
-					tx.Rollback()
-					dbMutex.Unlock()
-					results <- fmt.Errorf("error preparing statement for %s: %v", job.Path, err)
-					rowCounts <- 0
-					continue
-				}
-
-				// Batch insert rows
-				rowsInserted := 0
-				insertError := false
-				for _, doc := range docs {
-					if emailOnly {
-						// Extract email from content
-						email := extractEmail(doc["content"].(string))
-						if email != "" {
-							_, err = stmt.Exec(
-								doc["file"],
-								doc["sheet"],
-								doc["row"],
-								email,
-								doc["content"],
-							)
-						} else {
-							continue // Skip rows without email
-						}
-					} else {
-						_, err = stmt.Exec(
-							doc["file"],
-							doc["sheet"],
-							doc["row"],
-							doc["content"],
-						)
-					}
-
-					if err != nil {
-						log.Printf("Warning: Error inserting row for %s: %v", job.Path, err)
-						insertError = true
-						break
-					}
-					rowsInserted++
-				}
-
-				stmt.Close()
-				if insertError {
-					tx.Rollback()
-					dbMutex.Unlock()
-					results <- fmt.Errorf("error inserting data for %s: %v", job.Path, err)
-					rowCounts <- 0
+				// Drain the remaining jobs once cancelled
+				if ctx.Err() != nil {
 					continue
 				}
-
-				if err = tx.Commit(); err != nil {
-					dbMutex.Unlock()
-					results <- fmt.Errorf("error committing transaction for %s: %v", job.Path, err)
-					rowCounts <- 0
-					continue
-				}
-
-				// Unlock database access
-				dbMutex.Unlock()
-				results <- nil
-				rowCounts <- rowsInserted
+				start := time.Now()
+				result := importFile(ctx, database, &dbMutex, job, emailOnly, req.Mode, run.ID)
+				result.Path = job.Path
+				result.Elapsed = time.Since(start)
+				results <- result
 			}
 		}()
 	}
 
 	// Send jobs to workers
 	go func() {
-		for _, file := range files {
-			ext := filepath.Ext(file)
-			if len(ext) > 0 {
-				ext = ext[1:]
-			}
-			for _, allowedExt := range extensions {
-				if ext == allowedExt {
-					jobs <- ImportJob{
-						Path:      file,
-						Extension: ext,
-					}
-					break
-				}
+		defer close(jobs)
+		for _, job := range files {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
 			}
 		}
-		close(jobs)
 	}()
 
 	// Wait for all workers to finish
@@ -722,25 +706,251 @@ func importToSQLite(files []string, extensions []string, resetDB bool, emailOnly
 	totalRows := 0
 	totalFiles := 0
 	failedFiles := 0
+	skippedFiles := 0
 
-	for err := range results {
-		rows := <-rowCounts
+	for result := range results {
+		if result.Err != nil && ctx.Err() != nil {
+			// Rolled back by the cancellation rather than failed
+			continue
+		}
+		if progress.file != nil {
+			progress.file(result)
+		}
 		totalFiles++
-		if err != nil {
+		if result.Err != nil {
 			failedFiles++
-			importErrors = append(importErrors, err)
+			importErrors = append(importErrors, result.Err)
+			if err := recordFailedFile(database, result.Path, run.ID, result.Err); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		} else if result.Skipped {
+			skippedFiles++
 		} else {
-			totalRows += rows
+			totalRows += result.Rows
 		}
 	}
 
-	if len(importErrors) > 0 {
-		return fmt.Errorf("encountered %d errors during import: %v", len(importErrors), importErrors)
+	err = ctx.Err()
+	if err == nil && len(importErrors) > 0 {
+		err = fmt.Errorf("encountered %d errors during import: %v", len(importErrors), importErrors)
 	}
 
-	log.Printf("Import completed: %d rows imported from %d files (%d failed)", totalRows, totalFiles, failedFiles)
+	run.FilesDone = totalFiles
+	run.FilesFailed = failedFiles
+	run.FilesSkipped = skippedFiles
+	run.RowsInserted = totalRows
+	run.Status, run.Message = importOutcome(err, totalRows, totalFiles, skippedFiles)
+	if err := finishImportRun(database, run); err != nil {
+		log.Printf("Warning: %v", err)
+	}
 
-	return nil
+	log.Printf("Import %s: %d rows imported from %d files (%d failed, %d skipped)", run.Status, totalRows, totalFiles, failedFiles, skippedFiles)
+	return err
+}
+
+// importFile reads one file and writes its rows in a single transaction,
+// returning the number of rows inserted and the rows that could not be
+// read. Unless mode is IMPORT_APPEND the rows the file already has are
+// replaced. A file left alone by mode is skipped and reported as such.
+func importFile(ctx context.Context, database *sql.DB, dbMutex *sync.Mutex, job ImportJob, emailOnly bool, mode string, importID int64) ImportResult {
+	var record FileRecord
+	var err error
+
+	switch mode {
+	case IMPORT_APPEND, IMPORT_REPLACE:
+		record, err = fingerprintFile(job.Path)
+	case IMPORT_SKIP_IF_PRESENT:
+		var previous *FileRecord
+		previous, err = lookupFile(database, job.Path)
+		if err == nil && previous != nil && previous.Status == FILE_IMPORTED {
+			return ImportResult{Skipped: true}
+		}
+		record, err = fingerprintFile(job.Path)
+	default:
+		var unchanged bool
+		record, unchanged, err = checkFileChanged(database, job.Path)
+		if err == nil && unchanged {
+			return ImportResult{Skipped: true}
+		}
+	}
+	if err != nil {
+		return ImportResult{Err: fmt.Errorf("error reading file %s: %v", job.Path, err)}
+	}
+	if limit := importSettings.MaxFileSizeMB; limit > 0 && record.Size > limit<<20 {
+		return ImportResult{Err: fmt.Errorf("file %s is larger than the %d MB limit", job.Path, limit)}
+	}
+	record.ImportID = importID
+
+	// The file is read before the database is locked, so that other
+	// workers read their files meanwhile and searches are only held up by
+	// the writes
+	spool, err := spoolRows(ctx, job)
+	if err != nil {
+		return ImportResult{Err: fmt.Errorf("error reading file %s: %v", job.Path, err)}
+	}
+	defer spool.close()
+
+	// Lock database access
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	// Begin transaction for this file; it is rolled back if ctx is cancelled
+	tx, err := database.BeginTx(ctx, nil)
+	if err != nil {
+		return ImportResult{Err: fmt.Errorf("error starting transaction for %s: %v", job.Path, err)}
+	}
+	defer tx.Rollback()
+
+	if mode != IMPORT_APPEND {
+		if _, err := deleteFileRows(tx, emailOnly, job.Path); err != nil {
+			return ImportResult{Err: err}
+		}
+	}
+
+	// Prepare statement based on database type
+	var stmt *sql.Stmt
+	if emailOnly {
+		stmt, err = tx.Prepare(`
+			INSERT INTO email_content (file, sheet, row, email, content, cells)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`)
+	} else {
+		stmt, err = tx.Prepare(`
+			INSERT INTO files_content (file, sheet, row, content, cells)
+			VALUES (?, ?, ?, ?, ?)
+		`)
+	}
+	if err != nil {
+		return ImportResult{Err: fmt.Errorf("error preparing statement for %s: %v", job.Path, err)}
+	}
+	defer stmt.Close()
+
+	// Header rows are stored once per sheet
+	headerStmt, err := tx.Prepare(`
+		INSERT OR REPLACE INTO sheet_headers (file, sheet, headers)
+		VALUES (?, ?, ?)
+	`)
+	if err != nil {
+		return ImportResult{Err: fmt.Errorf("error preparing statement for %s: %v", job.Path, err)}
+	}
+	defer headerStmt.Close()
+
+	// Batch insert rows
+	rowsInserted := 0
+	// Header rows are stored once per sheet of each archive member
+	savedHeaders := make(map[[2]string]bool)
+	err = spool.each(func(batch []sheetRow) error {
+		for _, row := range batch {
+			if row.skipped != nil {
+				record.RowsSkipped++
+				if len(record.RowErrors) < MAX_ROW_ERRORS {
+					record.RowErrors = append(record.RowErrors, *row.skipped)
+				}
+				continue
+			}
+			if sheet := [2]string{row.file, row.sheet}; !savedHeaders[sheet] {
+				headers, _ := json.Marshal(row.headers)
+				if _, err := headerStmt.ExecContext(ctx, row.file, row.sheet, string(headers)); err != nil {
+					return fmt.Errorf("error saving headers for %s: %v", row.file, err)
+				}
+				savedHeaders[sheet] = true
+			}
+
+			var err error
+			if emailOnly {
+				// Extract email from content
+				email := extractEmail(row.content)
+				if email == "" {
+					continue // Skip rows without email
+				}
+				_, err = stmt.ExecContext(ctx, row.file, row.sheet, row.row, email, row.content, row.cells)
+			} else {
+				_, err = stmt.ExecContext(ctx, row.file, row.sheet, row.row, row.content, row.cells)
+			}
+
+			if err != nil {
+				return fmt.Errorf("error inserting data for %s: %v", job.Path, err)
+			}
+			rowsInserted++
+		}
+		return nil
+	})
+	if err != nil {
+		return ImportResult{Err: err}
+	}
+
+	if err := recordImportedFile(tx, getTableName(emailOnly), record); err != nil {
+		return ImportResult{Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return ImportResult{Err: fmt.Errorf("error committing transaction for %s: %v", job.Path, err)}
+	}
+	if record.RowsSkipped > 0 {
+		log.Printf("Warning: Skipped %d unreadable rows of %s", record.RowsSkipped, job.Path)
+	}
+	return ImportResult{Rows: rowsInserted, RowsSkipped: record.RowsSkipped, RowErrors: record.RowErrors}
+}
+
+// deleteFileRows removes every row and header of file, including those of
+// its archive members, within tx and returns the number of rows deleted.
+func deleteFileRows(tx *sql.Tx, emailOnly bool, file string) (int64, error) {
+	result, err := tx.Exec("DELETE FROM "+getTableName(emailOnly)+" WHERE "+FILE_ROWS_CONDITION, fileRowsArgs(file)...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting existing rows for %s: %v", file, err)
+	}
+	if _, err := tx.Exec("DELETE FROM sheet_headers WHERE "+FILE_ROWS_CONDITION, fileRowsArgs(file)...); err != nil {
+		return 0, fmt.Errorf("error deleting headers for %s: %v", file, err)
+	}
+	return result.RowsAffected()
+}
+
+// indexedFiles lists the files that have rows in the database together with
+// their extensions, for re-importing them. Re-importing replaces their rows,
+// which brings rows imported by older versions up to date with current row
+// numbering and column data. Archive members are re-imported with their
+// archive. Files that no longer exist are left out and keep their rows.
+func indexedFiles(store *Store, emailOnly bool) ([]string, []string, error) {
+	database := store.database(emailOnly)
+
+	rows, err := database.Query("SELECT DISTINCT file FROM " + getTableName(emailOnly))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing imported files: %v", err)
+	}
+	var files []string
+	seen := make(map[string]bool)
+	extensions := make(map[string]bool)
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("error listing imported files: %v", err)
+		}
+		file, member := splitArchivePath(file)
+		if member != "" {
+			extensions[normalizeExtension(filepath.Ext(member))] = true
+		}
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		if _, err := os.Stat(file); err != nil {
+			log.Printf("Warning: Skipping re-import of %s: %v", file, err)
+			continue
+		}
+		files = append(files, file)
+		extensions[normalizeExtension(filepath.Ext(file))] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error listing imported files: %v", err)
+	}
+
+	var extList []string
+	for ext := range extensions {
+		extList = append(extList, ext)
+	}
+	return files, extList, nil
 }
 
 func extractEmail(content string) string {
@@ -750,80 +960,108 @@ func extractEmail(content string) string {
 	return matches
 }
 
-func searchInSQLite(query string, page, pageSize int, emailOnly bool) ([]Match, int, error) {
-	if query == "" {
+func searchInSQLite(store *Store, req SearchRequest) ([]Match, int, error) {
+	if req.Query == "" {
 		return nil, 0, fmt.Errorf("search query cannot be empty")
 	}
 
-	// Select database based on search type
-	database := db
-	if emailOnly {
-		database = emailDB
+	parsed, err := parseQuery(req.Query, req.ExactAccents, req.EmailOnly)
+	if err != nil {
+		return nil, 0, err
+	}
+	filters := append(parsed.filters, requestFilters(req.Filters)...)
+	filters = append(filters, scopeFilters(req.Directories, req.Extensions)...)
+
+	// Select database and index based on search type
+	database := store.db
+	ftsTable := "files_fts"
+	ftsColumn := "content_folded"
+	selectColumns := "c.file, c.sheet, c.row, '' AS email, c.content, coalesce(c.cells, ''), coalesce(h.headers, '')"
+	// bm25 weights follow the files_fts columns: file, sheet, row, content, content_folded
+	rankExpr := "bm25(matchinfo(files_fts, 'pcnalx'), 0.0, 0.0, 0.0, 1.0, 1.0)"
+	if req.EmailOnly {
+		database = store.emailDB
+		ftsTable = "email_fts"
+		ftsColumn = "email_folded"
+		selectColumns = "c.file, c.sheet, c.row, c.email, c.content, coalesce(c.cells, ''), coalesce(h.headers, '')"
+		rankExpr = "bm25(matchinfo(email_fts, 'pcnalx'))"
+	}
+	if req.ExactAccents {
+		ftsColumn = strings.TrimSuffix(ftsColumn, "_folded")
 	}
 
-	var totalCount int
-	var rows *sql.Rows
-	var err error
+	// Build the FROM and WHERE clauses from the full-text terms and filters
+	from := getTableName(req.EmailOnly) + " c"
+	var where []string
+	var args []interface{}
+	joinedFTS := false
 
-	if emailOnly {
-		// Search in email database
-		err = database.QueryRow(`
-			SELECT COUNT(*) 
-			FROM email_content 
-			WHERE email LIKE ?
-		`, "%"+query+"%").Scan(&totalCount)
-		if err != nil {
-			return nil, 0, fmt.Errorf("database error getting count: %v", err)
+	matchQuery, exclude, err := compileQuery(req.Query, parsed, filters)
+	if err != nil {
+		return nil, 0, err
+	}
+	if matchQuery != "" {
+		if exclude {
+			where = append(where, fmt.Sprintf("c.rowid NOT IN (SELECT docid FROM %s WHERE %s MATCH ?)", ftsTable, ftsColumn))
+		} else {
+			from = fmt.Sprintf("%s JOIN %s c ON c.rowid = %s.docid", ftsTable, getTableName(req.EmailOnly), ftsTable)
+			where = append(where, fmt.Sprintf("%s.%s MATCH ?", ftsTable, ftsColumn))
+			joinedFTS = true
 		}
+		args = append(args, matchQuery)
+	}
+	from += " LEFT JOIN sheet_headers h ON h.file = c.file AND h.sheet = c.sheet"
 
-		offset := (page - 1) * pageSize
-		rows, err = database.Query(`
-			SELECT file, sheet, row, email, content
-			FROM email_content
-			WHERE email LIKE ?
-			ORDER BY row
-			LIMIT ? OFFSET ?
-		`, "%"+query+"%", pageSize, offset)
-	} else {
-		// Search in main database
-		err = database.QueryRow(`
-			SELECT COUNT(*) 
-			FROM files_content 
-			WHERE content LIKE ?
-		`, "%"+query+"%").Scan(&totalCount)
-		if err != nil {
-			return nil, 0, fmt.Errorf("database error getting count: %v", err)
-		}
+	for _, filter := range filters {
+		clause, filterArgs := filter.where(req.EmailOnly)
+		where = append(where, clause)
+		args = append(args, filterArgs...)
+	}
+	whereClause := strings.Join(where, " AND ")
 
-		offset := (page - 1) * pageSize
-		rows, err = database.Query(`
-			SELECT file, sheet, row, content
-			FROM files_content
-			WHERE content LIKE ?
-			ORDER BY row
-			LIMIT ? OFFSET ?
-		`, "%"+query+"%", pageSize, offset)
+	var totalCount int
+	err = database.QueryRow(fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM %s
+		WHERE %s
+	`, from, whereClause), args...).Scan(&totalCount)
+	if err != nil {
+		return nil, 0, fmt.Errorf("database error getting count: %v", err)
 	}
 
+	orderBy := "c.row"
+	if req.OrderBy == ORDER_BY_RANK && joinedFTS {
+		orderBy = "score DESC, c.row"
+	} else {
+		// Ranking every match is wasted work when ordering by row
+		rankExpr = "0.0"
+	}
+
+	offset := (req.Page - 1) * req.PageSize
+	rows, err := database.Query(fmt.Sprintf(`
+		SELECT %s, %s AS score
+		FROM %s
+		WHERE %s
+		ORDER BY %s
+		LIMIT ? OFFSET ?
+	`, selectColumns, rankExpr, from, whereClause, orderBy),
+		append(args, req.PageSize, offset)...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("database error: %v", err)
 	}
 	defer rows.Close()
 
+	hitTerms := positiveTerms(parsed.terms)
 	var matches []Match
 	for rows.Next() {
 		var match Match
-		if emailOnly {
-			err := rows.Scan(&match.File, &match.Sheet, &match.Row, &match.Email, &match.Content)
-			if err != nil {
-				return nil, 0, fmt.Errorf("error scanning results: %v", err)
-			}
-		} else {
-			err := rows.Scan(&match.File, &match.Sheet, &match.Row, &match.Content)
-			if err != nil {
-				return nil, 0, fmt.Errorf("error scanning results: %v", err)
-			}
+		var cells, headers string
+		err := rows.Scan(&match.File, &match.Sheet, &match.Row, &match.Email, &match.Content, &cells, &headers, &match.Score)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning results: %v", err)
 		}
+		match.Fields = rowFields(cells, headers)
+		match.Column = hitColumn(cells, hitTerms, req.ExactAccents)
 		matches = append(matches, match)
 	}
 
@@ -834,7 +1072,7 @@ func searchInSQLite(query string, page, pageSize int, emailOnly bool) ([]Match,
 	return matches, totalCount, nil
 }
 
-func importHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) importHandler(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 	log.Printf("Import request received at %v", startTime.Format(time.RFC3339))
 
@@ -851,53 +1089,83 @@ func importHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Import request: files=%v, extensions=%v, resetDB=%v, emailOnly=%v",
-		req.Files, req.Extensions, req.ResetDB, req.EmailOnly)
+	log.Printf("Import request: files=%v, roots=%v, extensions=%v, resetDB=%v, emailOnly=%v, mode=%v",
+		req.Files, req.Roots, req.Extensions, req.ResetDB, req.EmailOnly, req.Mode)
+
+	if !validImportMode(req.Mode) {
+		http.Error(w, fmt.Sprintf("Invalid mode %q", req.Mode), http.StatusBadRequest)
+		return
+	}
+	if err := validateCrawl(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateExtensions(req.Extensions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.CSV.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	err := importToSQLite(req.Files, req.Extensions, req.ResetDB, req.EmailOnly)
+	job, err := jobQueue.start(h.store, JOB_IMPORT, req)
 	if err != nil {
 		log.Printf("Import error: %v", err)
-		resp := ImportResponse{
-			Status:  "error",
-			Message: err.Error(),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	duration := time.Since(startTime)
-	log.Printf("Import completed in %v", duration)
+	writeJobAccepted(w, job)
+}
 
-	// Get the total rows from the appropriate database
-	var totalRows int
-	database := db
-	if req.EmailOnly {
-		database = emailDB
+// writeJobAccepted answers an import request with the job running it.
+// Progress is then polled from GET /jobs/{id}.
+func writeJobAccepted(w http.ResponseWriter, job Job) {
+	resp := ImportResponse{
+		Status:     job.Status,
+		Message:    fmt.Sprintf("Import job %s started for %d files", job.ID, job.FilesTotal),
+		TotalFiles: job.FilesTotal,
+		JobID:      job.ID,
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
 
-	err = database.QueryRow("SELECT COUNT(*) FROM " + getTableName(req.EmailOnly)).Scan(&totalRows)
-	if err != nil {
-		log.Printf("Warning: Could not get total rows: %v", err)
-		totalRows = 0
+func (h *handlers) reimportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Get the total number of unique files from the database
-	var totalFiles int
-	err = database.QueryRow("SELECT COUNT(DISTINCT file) FROM " + getTableName(req.EmailOnly)).Scan(&totalFiles)
+	var req StatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Re-import request: emailOnly=%v", req.EmailOnly)
+	files, extensions, err := indexedFiles(h.store, req.EmailOnly)
 	if err != nil {
-		log.Printf("Warning: Could not get total files: %v", err)
-		totalFiles = 0
+		log.Printf("Re-import error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	resp := ImportResponse{
-		Status:     "success",
-		Message:    fmt.Sprintf("Data imported successfully in %v", duration),
-		TotalRows:  totalRows,
-		TotalFiles: totalFiles,
+	job, err := jobQueue.start(h.store, JOB_REIMPORT, ImportRequest{
+		Files:      files,
+		Extensions: extensions,
+		EmailOnly:  req.EmailOnly,
+		Mode:       IMPORT_REPLACE,
+	})
+	if err != nil {
+		log.Printf("Re-import error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+
+	writeJobAccepted(w, job)
 }
 
 func getTableName(isEmailDB bool) string {
@@ -907,7 +1175,7 @@ func getTableName(isEmailDB bool) string {
 	return "files_content"
 }
 
-func searchHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) searchHandler(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 	log.Printf("Search request received at %v", startTime.Format(time.RFC3339))
 
@@ -937,11 +1205,27 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	if req.PageSize < 1 {
 		req.PageSize = 10
 	}
+	if req.OrderBy == "" {
+		req.OrderBy = ORDER_BY_ROW
+	}
+	if req.OrderBy != ORDER_BY_ROW && req.OrderBy != ORDER_BY_RANK {
+		log.Printf("Invalid orderBy: %q", req.OrderBy)
+		http.Error(w, fmt.Sprintf("orderBy must be %q or %q", ORDER_BY_ROW, ORDER_BY_RANK), http.StatusBadRequest)
+		return
+	}
 
-	log.Printf("Search request: query=%q, directories=%v, extensions=%v, page=%d, pageSize=%d, emailOnly=%v",
-		req.Query, req.Directories, req.Extensions, req.Page, req.PageSize, req.EmailOnly)
+	log.Printf("Search request: query=%q, directories=%v, extensions=%v, page=%d, pageSize=%d, emailOnly=%v, orderBy=%s, exactAccents=%v",
+		req.Query, req.Directories, req.Extensions, req.Page, req.PageSize, req.EmailOnly, req.OrderBy, req.ExactAccents)
 
-	matches, totalCount, err := searchInSQLite(req.Query, req.Page, req.PageSize, req.EmailOnly)
+	matches, totalCount, err := searchInSQLite(h.store, req)
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		log.Printf("Invalid search query: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(queryErr)
+		return
+	}
 	if err != nil {
 		log.Printf("Search error: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -966,7 +1250,7 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) statusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -979,10 +1263,7 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Select database based on emailOnly flag
-	database := db
-	if req.EmailOnly {
-		database = emailDB
-	}
+	database := h.store.database(req.EmailOnly)
 
 	// Get total rows
 	var totalRows int
@@ -994,31 +1275,41 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get database size
-	dbSize, err := getDatabaseSize(req.EmailOnly)
+	dbSize, err := getDatabaseSize(database)
 	if err != nil {
 		log.Printf("Error getting database size: %v", err)
 		http.Error(w, "Error getting status", http.StatusInternalServerError)
 		return
 	}
 
-	// Get last import time from log file
+	// Get file counts and the last import from the file registry
+	totalFiles, failedFiles, err := countFiles(database)
+	if err != nil {
+		log.Printf("Error getting file counts: %v", err)
+		http.Error(w, "Error getting status", http.StatusInternalServerError)
+		return
+	}
+
 	lastImport := "Unknown"
-	if logFile, err := os.Open("finder.log"); err == nil {
-		defer logFile.Close()
-		scanner := bufio.NewScanner(logFile)
-		var lastLine string
-		for scanner.Scan() {
-			lastLine = scanner.Text()
-		}
-		if strings.Contains(lastLine, "Import completed") {
-			lastImport = lastLine
+	runs, err := listImportRuns(database, "", 1)
+	if err != nil {
+		log.Printf("Error getting last import: %v", err)
+		http.Error(w, "Error getting status", http.StatusInternalServerError)
+		return
+	}
+	if len(runs) > 0 {
+		run := runs[0]
+		lastImport = fmt.Sprintf("%s (%s", run.StartedAt.Format("2006-01-02 15:04:05"), run.Status)
+		if run.Message != "" {
+			lastImport += ": " + run.Message
 		}
+		lastImport += ")"
 	}
 
 	resp := StatusResponse{
 		TotalRows:   totalRows,
-		TotalFiles:  0, // This would need to be tracked separately if needed
-		FailedFiles: 0, // This would need to be tracked separately if needed
+		TotalFiles:  totalFiles,
+		FailedFiles: failedFiles,
 		LastImport:  lastImport,
 		DBSize:      fmt.Sprintf("%.2f MB", float64(dbSize)/1024/1024),
 	}
@@ -1027,40 +1318,35 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func checkImportedFiles(files []string, emailOnly bool) ([]string, []string, error) {
-	database := db
-	if emailOnly {
-		database = emailDB
-	}
-
-	tableName := getTableName(emailOnly)
+// checkImportedFiles splits files by whether their last import succeeded,
+// according to the file registry, and returns the registry entries found.
+func checkImportedFiles(store *Store, files []string, emailOnly bool) ([]string, []string, []FileRecord, error) {
+	database := store.database(emailOnly)
 
 	var importedFiles []string
 	var notImportedFiles []string
+	records := []FileRecord{}
 
 	for _, file := range files {
-		var count int
-		err := database.QueryRow(fmt.Sprintf(`
-			SELECT COUNT(*) 
-			FROM %s 
-			WHERE file = ?
-		`, tableName), file).Scan(&count)
-
+		record, err := lookupFile(database, file)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error checking file %s: %v", file, err)
+			return nil, nil, nil, err
+		}
+		if record != nil {
+			records = append(records, *record)
 		}
 
-		if count > 0 {
+		if record != nil && record.Status == FILE_IMPORTED {
 			importedFiles = append(importedFiles, file)
 		} else {
 			notImportedFiles = append(notImportedFiles, file)
 		}
 	}
 
-	return importedFiles, notImportedFiles, nil
+	return importedFiles, notImportedFiles, records, nil
 }
 
-func checkFilesHandler(w http.ResponseWriter, r *http.Request) {
+func (h *handlers) checkFilesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -1073,7 +1359,7 @@ func checkFilesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check in the appropriate database based on emailOnly flag
-	importedFiles, notImportedFiles, err := checkImportedFiles(req.Files, req.EmailOnly)
+	importedFiles, notImportedFiles, records, err := checkImportedFiles(h.store, req.Files, req.EmailOnly)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1082,6 +1368,7 @@ func checkFilesHandler(w http.ResponseWriter, r *http.Request) {
 	resp := CheckFilesResponse{
 		ImportedFiles:    importedFiles,
 		NotImportedFiles: notImportedFiles,
+		Files:            records,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1089,8 +1376,17 @@ func checkFilesHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	config, args, err := loadSettings(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	importSettings = config.Import
+
 	// Set up logging to file
-	logFile, err := os.OpenFile("finder.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	logFile, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatal("Failed to open log file:", err)
 	}
@@ -1106,15 +1402,18 @@ func main() {
 		Description: "A service for importing and searching files.",
 	}
 
-	prg := &program{}
+	// An installed service runs with the same flags
+	svcConfig.Arguments = os.Args[1 : len(os.Args)-len(args)]
+
+	prg := &program{config: config}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if len(os.Args) > 1 {
-		log.Printf("Service command received: %s", os.Args[1])
-		err = service.Control(s, os.Args[1])
+	if len(args) > 0 {
+		log.Printf("Service command received: %s", args[0])
+		err = service.Control(s, args[0])
 		if err != nil {
 			fmt.Printf("Valid actions: %q\n", service.ControlAction)
 			log.Fatal(err)
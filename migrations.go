@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Each database records the migrations applied to it in schema_version, and
+// Store.Migrate applies the missing ones in order, each in a transaction.
+// Databases from before schema_version existed start at version 0; the first
+// migrations only create what is missing, so they upgrade whatever older
+// layout such a database has. New schema changes are appended as new
+// migrations and never edit released ones.
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// migration is one schema change. Destructive migrations drop or rewrite
+// data, so the database is backed up before they run.
+type migration struct {
+	version     int
+	description string
+	destructive bool
+	apply       func(tx querier) error
+}
+
+// schema describes the tables of one of the databases.
+type schema struct {
+	contentTable string
+	// resetTables are dropped by ImportRequest.ResetDB
+	resetTables []string
+	migrations  []migration
+}
+
+var mainSchema = schema{
+	contentTable: "files_content",
+	resetTables:  []string{"files_content", "files_fts", "sheet_headers", "files"},
+	migrations: []migration{
+		{1, "content table", false, func(tx querier) error {
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS files_content (
+					file TEXT,
+					sheet TEXT,
+					row INTEGER,
+					content TEXT
+				);
+
+				-- Index on file for replacing a file's rows
+				CREATE INDEX IF NOT EXISTS idx_files_file ON files_content(file);
+			`)
+			if err != nil {
+				return fmt.Errorf("error creating content table: %v", err)
+			}
+			return nil
+		}},
+		{2, "cells and sheet headers", false, func(tx querier) error {
+			return createColumnTables(tx, "files_content")
+		}},
+		{3, "file registry and import history", false, func(tx querier) error {
+			return createRegistryTables(tx, "files_content")
+		}},
+		{4, "accent folded full-text index", true, func(tx querier) error {
+			// Tables from before accent folding used the simple tokenizer and
+			// have no folded column; drop them so they are recreated and
+			// rebuilt below
+			if err := dropFTSIfOutdated(tx, "files_fts", "content_folded"); err != nil {
+				return err
+			}
+
+			// content keeps the original accents for exact searches,
+			// content_folded holds fold(content)
+			_, err := tx.Exec(`
+				CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts4(
+					file,
+					sheet,
+					row,
+					content,
+					content_folded,
+					tokenize=unicode61 "remove_diacritics=0"
+				)
+			`)
+			if err != nil {
+				return fmt.Errorf("error creating FTS4 table: %v", err)
+			}
+
+			// Databases created before the FTS docid was tied to the content
+			// rowid, or before folded text was indexed, need their index
+			// rebuilt
+			err = rebuildFTSIfNeeded(tx, "files_ai", "fold(", "files_fts", `
+				INSERT INTO files_fts(docid, file, sheet, row, content, content_folded)
+				SELECT rowid, file, sheet, row, content, fold(content) FROM files_content;
+			`)
+			if err != nil {
+				return err
+			}
+
+			// Triggers maintaining the FTS4 table, keyed by the content rowid
+			_, err = tx.Exec(`
+				DROP TRIGGER IF EXISTS files_ai;
+				DROP TRIGGER IF EXISTS files_ad;
+				DROP TRIGGER IF EXISTS files_au;
+
+				CREATE TRIGGER files_ai AFTER INSERT ON files_content BEGIN
+					INSERT INTO files_fts(docid, file, sheet, row, content, content_folded)
+					VALUES (new.rowid, new.file, new.sheet, new.row, new.content, fold(new.content));
+				END;
+
+				CREATE TRIGGER files_ad AFTER DELETE ON files_content BEGIN
+					DELETE FROM files_fts WHERE docid = old.rowid;
+				END;
+
+				CREATE TRIGGER files_au AFTER UPDATE ON files_content BEGIN
+					DELETE FROM files_fts WHERE docid = old.rowid;
+					INSERT INTO files_fts(docid, file, sheet, row, content, content_folded)
+					VALUES (new.rowid, new.file, new.sheet, new.row, new.content, fold(new.content));
+				END;
+			`)
+			if err != nil {
+				return fmt.Errorf("error creating triggers: %v", err)
+			}
+			return nil
+		}},
+		{5, "skipped rows of files", false, addRowErrorColumns},
+	},
+}
+
+var emailSchema = schema{
+	contentTable: "email_content",
+	resetTables:  []string{"email_content", "email_fts", "sheet_headers", "files"},
+	migrations: []migration{
+		{1, "email content table", false, func(tx querier) error {
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS email_content (
+					file TEXT,
+					sheet TEXT,
+					row INTEGER,
+					email TEXT,
+					content TEXT
+				);
+
+				CREATE INDEX IF NOT EXISTS idx_email ON email_content(email);
+
+				-- Index on file for replacing a file's rows
+				CREATE INDEX IF NOT EXISTS idx_email_file ON email_content(file);
+			`)
+			if err != nil {
+				return fmt.Errorf("error creating email content table: %v", err)
+			}
+			return nil
+		}},
+		{2, "cells and sheet headers", false, func(tx querier) error {
+			return createColumnTables(tx, "email_content")
+		}},
+		{3, "file registry and import history", false, func(tx querier) error {
+			return createRegistryTables(tx, "email_content")
+		}},
+		{4, "accent folded email index", true, func(tx querier) error {
+			if err := dropFTSIfOutdated(tx, "email_fts", "email_folded"); err != nil {
+				return err
+			}
+
+			// FTS4 table over the email column, with a folded copy
+			_, err := tx.Exec(`
+				CREATE VIRTUAL TABLE IF NOT EXISTS email_fts USING fts4(
+					email,
+					email_folded,
+					tokenize=unicode61 "remove_diacritics=0"
+				)
+			`)
+			if err != nil {
+				return fmt.Errorf("error creating email FTS4 table: %v", err)
+			}
+
+			err = rebuildFTSIfNeeded(tx, "email_ai", "fold(", "email_fts", `
+				INSERT INTO email_fts(docid, email, email_folded)
+				SELECT rowid, email, fold(email) FROM email_content;
+			`)
+			if err != nil {
+				return err
+			}
+
+			// Triggers maintaining the email FTS4 table, keyed by the content
+			// rowid
+			_, err = tx.Exec(`
+				DROP TRIGGER IF EXISTS email_ai;
+				DROP TRIGGER IF EXISTS email_ad;
+				DROP TRIGGER IF EXISTS email_au;
+
+				CREATE TRIGGER email_ai AFTER INSERT ON email_content BEGIN
+					INSERT INTO email_fts(docid, email, email_folded)
+					VALUES (new.rowid, new.email, fold(new.email));
+				END;
+
+				CREATE TRIGGER email_ad AFTER DELETE ON email_content BEGIN
+					DELETE FROM email_fts WHERE docid = old.rowid;
+				END;
+
+				CREATE TRIGGER email_au AFTER UPDATE ON email_content BEGIN
+					DELETE FROM email_fts WHERE docid = old.rowid;
+					INSERT INTO email_fts(docid, email, email_folded)
+					VALUES (new.rowid, new.email, fold(new.email));
+				END;
+			`)
+			if err != nil {
+				return fmt.Errorf("error creating email triggers: %v", err)
+			}
+			return nil
+		}},
+		{5, "skipped rows of files", false, addRowErrorColumns},
+	},
+}
+
+// migrate applies the migrations of s that the database at path is missing.
+// Before a destructive migration touches a database holding rows, the
+// database is copied next to path.
+func migrate(database *sql.DB, path string, s schema) error {
+	_, err := database.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT,
+			applied_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %v", err)
+	}
+
+	var current int
+	err = database.QueryRow("SELECT coalesce(MAX(version), 0) FROM schema_version").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("error reading schema version of %s: %v", path, err)
+	}
+
+	latest := s.migrations[len(s.migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database %s has schema version %d, newer than the %d this version of finder supports", path, current, latest)
+	}
+
+	var pending []migration
+	destructive := false
+	for _, m := range s.migrations {
+		if m.version > current {
+			pending = append(pending, m)
+			destructive = destructive || m.destructive
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if destructive {
+		hasRows, err := tableHasRows(database, s.contentTable)
+		if err != nil {
+			return err
+		}
+		if hasRows {
+			if err := backupDatabase(database, path, current); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range pending {
+		log.Printf("Migrating %s to schema version %d: %s", path, m.version, m.description)
+		if err := applyMigration(database, m); err != nil {
+			return fmt.Errorf("error migrating %s to schema version %d: %v", path, m.version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(database *sql.DB, m migration) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)
+	`, m.version, m.description, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableHasRows reports whether table exists and is not empty.
+func tableHasRows(database *sql.DB, table string) (bool, error) {
+	var exists int
+	err := database.QueryRow(`
+		SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?
+	`, table).Scan(&exists)
+	if err != nil || exists == 0 {
+		return false, err
+	}
+
+	var hasRows bool
+	err = database.QueryRow("SELECT EXISTS (SELECT 1 FROM " + table + ")").Scan(&hasRows)
+	if err != nil {
+		return false, fmt.Errorf("error reading %s: %v", table, err)
+	}
+	return hasRows, nil
+}
+
+// backupDatabase copies the database at path, at schema version version, to
+// a file next to it named after the version and the time.
+func backupDatabase(database *sql.DB, path string, version int) error {
+	backup := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().Format("20060102-150405"))
+	if _, err := database.Exec("VACUUM INTO ?", backup); err != nil {
+		return fmt.Errorf("error backing up %s to %s: %v", path, backup, err)
+	}
+	log.Printf("Backed up %s to %s before migrating it", path, backup)
+	return nil
+}
+
+// resetSchema drops the tables of s and creates them again empty.
+func resetSchema(database *sql.DB, path string, s schema) error {
+	for _, table := range s.resetTables {
+		if _, err := database.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			return fmt.Errorf("error dropping table %s: %v", table, err)
+		}
+	}
+	if _, err := database.Exec("DELETE FROM schema_version"); err != nil {
+		return fmt.Errorf("error resetting schema version: %v", err)
+	}
+	return migrate(database, path, s)
+}
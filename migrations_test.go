@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openTestStore opens and migrates a store whose databases are in dir. It is
+// closed when the test ends.
+func openTestStore(t *testing.T, dir string) *Store {
+	store := newStore(filepath.Join(dir, DB_PATH), filepath.Join(dir, EMAIL_DB_PATH))
+	if err := store.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DB_PATH)
+
+	// The layout of the first versions: the content table and a full-text
+	// index without folded text, kept up to date by a trigger
+	baseline, err := sql.Open(SQLITE_DRIVER, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = baseline.Exec(`
+		CREATE TABLE files_content (file TEXT, sheet TEXT, row INTEGER, content TEXT);
+		CREATE VIRTUAL TABLE files_fts USING fts4(file, sheet, row, content);
+		CREATE TRIGGER files_ai AFTER INSERT ON files_content BEGIN
+			INSERT INTO files_fts(file, sheet, row, content)
+			VALUES (new.file, new.sheet, new.row, new.content);
+		END;
+
+		INSERT INTO files_content VALUES ('/data/a.xlsx', 'Sheet1', 2, 'Nguyễn Văn An - Hà Nội');
+		INSERT INTO files_content VALUES ('/data/a.xlsx', 'Sheet1', 3, 'Trần Thị Bình - Huế');
+		INSERT INTO files_content VALUES ('/data/b.csv', 'b', 2, 'Lê Văn Cường - Đà Nẵng');
+	`)
+	baseline.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openTestStore(t, dir)
+
+	backups, err := filepath.Glob(path + ".v0-*.bak")
+	if err != nil || len(backups) != 1 {
+		t.Errorf("backups %q, %v; want one copy of the version 0 database", backups, err)
+	}
+
+	var version int
+	if err := store.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	latest := mainSchema.migrations[len(mainSchema.migrations)-1].version
+	if version != latest {
+		t.Errorf("schema version %d; want %d", version, latest)
+	}
+
+	// Old rows are found without their accents through the folded column
+	matches, total, err := searchInSQLite(store, SearchRequest{Query: "nguyen", Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(matches) != 1 || matches[0].File != "/data/a.xlsx" || matches[0].Row != 2 {
+		t.Errorf("search for nguyen found %d: %+v; want row 2 of /data/a.xlsx", total, matches)
+	}
+	if _, total, err = searchInSQLite(store, SearchRequest{Query: "da nang", Page: 1, PageSize: 10}); err != nil || total != 1 {
+		t.Errorf("search for da nang found %d, %v; want 1", total, err)
+	}
+
+	// The files already imported are registered with their row counts
+	rows, err := store.db.Query("SELECT path, row_count, status FROM files ORDER BY path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	want := []struct {
+		path  string
+		count int
+	}{{"/data/a.xlsx", 2}, {"/data/b.csv", 1}}
+	i := 0
+	for ; rows.Next(); i++ {
+		var path, status string
+		var count int
+		if err := rows.Scan(&path, &count, &status); err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) || path != want[i].path || count != want[i].count || status != FILE_IMPORTED {
+			t.Errorf("registered %s with %d rows as %s", path, count, status)
+		}
+	}
+	if i != len(want) {
+		t.Errorf("%d files registered; want %d", i, len(want))
+	}
+
+	// A second run finds nothing left to migrate
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := filepath.Glob(path + ".v*.bak"); len(backups) != 1 {
+		t.Errorf("backups %q after migrating again; want no new one", backups)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir)
+	if _, err := store.db.Exec("INSERT INTO schema_version (version) VALUES (1000)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Migrate(); err == nil {
+		t.Error("migrated a database of a newer version; want an error")
+	}
+}
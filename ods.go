@@ -0,0 +1,251 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Namespaces of the OpenDocument elements read from content.xml
+const (
+	ODS_OFFICE_NS = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	ODS_TABLE_NS  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	ODS_TEXT_NS   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+)
+
+// readODSFile reads the sheets of an OpenDocument spreadsheet, calling emit
+// with every non-empty row after the header row of each sheet. The sheets
+// are streamed from content.xml a row at a time.
+func readODSFile(path string, emit func(sheetRow) error) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("failed to open ODS file: %v", err)
+	}
+	defer archive.Close()
+
+	var content io.ReadCloser
+	for _, f := range archive.File {
+		if f.Name == "content.xml" {
+			if content, err = f.Open(); err != nil {
+				return fmt.Errorf("failed to open ODS file: %v", err)
+			}
+			break
+		}
+	}
+	if content == nil {
+		return fmt.Errorf("failed to open ODS file: content.xml is missing")
+	}
+	defer content.Close()
+
+	decoder := xml.NewDecoder(content)
+	sheets := 0
+	var sheet string
+	var headers []string
+	rowNum := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading ODS content: %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space != ODS_TABLE_NS {
+				continue
+			}
+			switch t.Name.Local {
+			case "table":
+				sheets++
+				sheet = odsAttr(t, ODS_TABLE_NS, "name")
+				if sheet == "" {
+					sheet = fmt.Sprintf("Sheet%d", sheets)
+				}
+				headers = nil
+				rowNum = 0
+
+			case "table-row":
+				if sheet == "" {
+					continue
+				}
+				cells, err := readODSRow(decoder)
+				if err != nil {
+					return fmt.Errorf("error reading sheet %s: %v", sheet, err)
+				}
+
+				// Blank rows are usually stored once with a repeat count,
+				// which advances the row number
+				repeat := odsRepeat(t, "number-rows-repeated")
+				for i := 0; i < repeat; i++ {
+					rowNum++
+					if rowNum == 1 {
+						headers = normalizeHeaders(cells)
+						continue
+					}
+					if len(cells) == 0 {
+						rowNum += repeat - i - 1
+						break
+					}
+
+					// Join all values with a separator
+					err := emit(sheetRow{
+						sheet:   sheet,
+						row:     rowNum,
+						content: strings.Join(cells, " - "),
+						cells:   encodeCells(cells),
+						headers: headers,
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+		case xml.EndElement:
+			if t.Name.Space == ODS_TABLE_NS && t.Name.Local == "table" {
+				sheet = ""
+			}
+		}
+	}
+}
+
+// readODSRow reads the cells of the table-row element just started, up to
+// its end, without trailing blank cells.
+func readODSRow(decoder *xml.Decoder) ([]string, error) {
+	var cells []string
+	// Blank cells are only added once a value follows them, so the
+	// thousands of repeated blank cells ending rows cost nothing
+	blanks := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space != ODS_TABLE_NS || (t.Name.Local != "table-cell" && t.Name.Local != "covered-table-cell") {
+				if err := decoder.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			value, err := readODSCell(decoder, t)
+			if err != nil {
+				return nil, err
+			}
+			repeat := odsRepeat(t, "number-columns-repeated")
+			if value == "" {
+				blanks += repeat
+				continue
+			}
+			for ; blanks > 0; blanks-- {
+				cells = append(cells, "")
+			}
+			for i := 0; i < repeat; i++ {
+				cells = append(cells, value)
+			}
+
+		case xml.EndElement:
+			return cells, nil
+		}
+	}
+}
+
+// readODSCell returns the text shown in the cell element start, reading up
+// to its end. Paragraphs are joined by new lines; a cell without text gives
+// its typed value, if any.
+func readODSCell(decoder *xml.Decoder, start xml.StartElement) (string, error) {
+	var text strings.Builder
+	paragraphs := 0
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Space == ODS_OFFICE_NS && t.Name.Local == "annotation":
+				// Comments are not part of the value
+				if err := decoder.Skip(); err != nil {
+					return "", err
+				}
+				continue
+			case t.Name.Space == ODS_TEXT_NS && t.Name.Local == "p" && depth == 0:
+				if paragraphs > 0 {
+					text.WriteString("\n")
+				}
+				paragraphs++
+			case t.Name.Space == ODS_TEXT_NS && t.Name.Local == "s":
+				count, err := strconv.Atoi(odsAttr(t, ODS_TEXT_NS, "c"))
+				if err != nil || count < 1 {
+					count = 1
+				}
+				text.WriteString(strings.Repeat(" ", count))
+			case t.Name.Space == ODS_TEXT_NS && t.Name.Local == "tab":
+				text.WriteString("\t")
+			case t.Name.Space == ODS_TEXT_NS && t.Name.Local == "line-break":
+				text.WriteString("\n")
+			}
+			depth++
+
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(t)
+			}
+
+		case xml.EndElement:
+			if depth == 0 {
+				if text.Len() > 0 {
+					return text.String(), nil
+				}
+				return odsTypedValue(start), nil
+			}
+			depth--
+		}
+	}
+}
+
+// odsTypedValue returns the value attribute matching the value type of a
+// cell.
+func odsTypedValue(cell xml.StartElement) string {
+	switch odsAttr(cell, ODS_OFFICE_NS, "value-type") {
+	case "float", "percentage", "currency":
+		return odsAttr(cell, ODS_OFFICE_NS, "value")
+	case "date":
+		return odsAttr(cell, ODS_OFFICE_NS, "date-value")
+	case "time":
+		return odsAttr(cell, ODS_OFFICE_NS, "time-value")
+	case "boolean":
+		return odsAttr(cell, ODS_OFFICE_NS, "boolean-value")
+	case "string":
+		return odsAttr(cell, ODS_OFFICE_NS, "string-value")
+	}
+	return ""
+}
+
+func odsAttr(element xml.StartElement, space, local string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Space == space && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// odsRepeat returns the repeat count of a row or cell, at least 1.
+func odsRepeat(element xml.StartElement, attr string) int {
+	repeat, err := strconv.Atoi(odsAttr(element, ODS_TABLE_NS, attr))
+	if err != nil || repeat < 1 {
+		return 1
+	}
+	return repeat
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const odsMimetype = "application/vnd.oasis.opendocument.spreadsheet"
+
+// odsContent wraps the tables of a spreadsheet in an OpenDocument
+// content.xml.
+func odsContent(tables string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content
+    xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+    xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+    xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+    xmlns:dc="http://purl.org/dc/elements/1.1/">
+<office:body><office:spreadsheet>` + tables + `</office:spreadsheet></office:body>
+</office:document-content>`
+}
+
+// writeODS writes an OpenDocument spreadsheet with the given content.xml to
+// dir. As the specification asks, its mimetype entry comes first and is
+// stored uncompressed, unless mimetypeFirst is false.
+func writeODS(t *testing.T, dir, name, content string, mimetypeFirst bool) string {
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	add := func(header *zip.FileHeader, data string) {
+		w, err := archive.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mimetype := &zip.FileHeader{Name: "mimetype", Method: zip.Store}
+	if mimetypeFirst {
+		add(mimetype, odsMimetype)
+	}
+	add(&zip.FileHeader{Name: "META-INF/manifest.xml", Method: zip.Deflate}, `<?xml version="1.0"?><manifest/>`)
+	add(&zip.FileHeader{Name: "content.xml", Method: zip.Deflate}, content)
+	if !mimetypeFirst {
+		mimetype.Method = zip.Deflate
+		add(mimetype, odsMimetype)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadODSFile(t *testing.T) {
+	content := odsContent(`
+<table:table table:name="Customers">
+  <table:table-column table:number-columns-repeated="3"/>
+  <table:table-row>
+    <table:table-cell office:value-type="string"><text:p>Name</text:p></table:table-cell>
+    <table:table-cell><text:p>City</text:p></table:table-cell>
+    <table:table-cell><text:p>Joined</text:p></table:table-cell>
+  </table:table-row>
+  <table:table-row>
+    <table:table-cell><text:p>An</text:p></table:table-cell>
+    <table:table-cell><text:p>Ha<text:s text:c="2"/>Noi</text:p></table:table-cell>
+    <table:table-cell office:value-type="date" office:date-value="2024-05-01"/>
+  </table:table-row>
+  <table:table-row table:number-rows-repeated="3">
+    <table:table-cell table:number-columns-repeated="3"/>
+  </table:table-row>
+  <table:table-row>
+    <table:table-cell>
+      <office:annotation><dc:creator>Lan</dc:creator><text:p>check this</text:p></office:annotation>
+      <text:p>Binh</text:p>
+    </table:table-cell>
+    <table:table-cell/>
+    <table:table-cell table:number-columns-repeated="2"><text:p>x</text:p></table:table-cell>
+    <table:table-cell office:value-type="float" office:value="1.5"><text:p>1,50</text:p></table:table-cell>
+    <table:table-cell office:value-type="currency" office:value="1500"/>
+    <table:table-cell office:value-type="boolean" office:boolean-value="true"/>
+    <table:table-cell table:number-columns-repeated="1017"/>
+  </table:table-row>
+  <table:table-row table:number-rows-repeated="2">
+    <table:table-cell><text:p>Same</text:p></table:table-cell>
+  </table:table-row>
+  <table:table-row table:number-rows-repeated="1048563">
+    <table:table-cell table:number-columns-repeated="1024"/>
+  </table:table-row>
+</table:table>
+<table:table table:name="Orders">
+  <table:table-row>
+    <table:table-cell><text:p>Order</text:p></table:table-cell>
+    <table:table-cell><text:p>Note</text:p></table:table-cell>
+  </table:table-row>
+  <table:table-row>
+    <table:table-cell><text:p>O-1</text:p></table:table-cell>
+    <table:table-cell table:number-columns-spanned="2"><text:p>first</text:p><text:p>second<text:line-break/>third</text:p></table:table-cell>
+    <table:covered-table-cell/>
+  </table:table-row>
+  <table:table-row>
+    <table:table-cell office:value-type="time" office:time-value="PT13H30M00S"/>
+  </table:table-row>
+</table:table>`)
+	path := writeODS(t, t.TempDir(), "book.ods", content, true)
+
+	var rows []string
+	headers := make(map[string][]string)
+	err := readODSFile(path, func(row sheetRow) error {
+		rows = append(rows, fmt.Sprintf("%s %d: %s", row.sheet, row.row, row.content))
+		headers[row.sheet] = row.headers
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"Customers 2: An - Ha  Noi - 2024-05-01",
+		// Rows 3 to 5 are blank
+		"Customers 6: Binh -  - x - x - 1,50 - 1500 - true",
+		"Customers 7: Same",
+		"Customers 8: Same",
+		"Orders 2: O-1 - first\nsecond\nthird",
+		"Orders 3: PT13H30M00S",
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %q; want %q", rows, want)
+	}
+	wantHeaders := map[string][]string{
+		"Customers": normalizeHeaders([]string{"Name", "City", "Joined"}),
+		"Orders":    normalizeHeaders([]string{"Order", "Note"}),
+	}
+	if !reflect.DeepEqual(headers, wantHeaders) {
+		t.Errorf("headers %q; want %q", headers, wantHeaders)
+	}
+}
+
+func TestReadODSFileWithoutContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.ods")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	w, _ := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	w.Write([]byte(odsMimetype))
+	archive.Close()
+	file.Close()
+
+	err = readODSFile(path, func(sheetRow) error { return nil })
+	if err == nil {
+		t.Error("read an ODS file without content.xml; want an error")
+	}
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Search queries support a small boolean language on top of plain words:
+//
+//	nguyen hanoi            both words (bare words match as prefixes)
+//	"nguyen van an"         exact phrase
+//	"nguyen van"*           phrase whose last word is a prefix
+//	acme OR globex          either word
+//	acme NOT test, -test    exclude rows containing test
+//	+acme                   required word, same as a bare word
+//	(acme OR globex) -test  grouping
+//	file:D:\2023\*          only files matching a path glob
+//	sheet:"Customer List"   only rows of a sheet (globs allowed)
+//	row:10-20, row:100-     only rows in a range
+//	email:gmail.com         only rows with an email at that domain
+//	-sheet:Archive          exclude a sheet
+//	Phone:0903*             only rows whose Phone column matches
+//	"Company Name":acme     column names with spaces are quoted
+//
+// AND, OR and NOT are only operators in upper case. Field qualifiers are
+// filters on the matched rows and may only appear at the top level of the
+// query, optionally negated. Queries are parsed into a tree and compiled to
+// an FTS MATCH expression, so user input is never pasted into the expression
+// as-is.
+
+// QueryError describes invalid query syntax. Position is the 0-based
+// character offset of Token within the query.
+type QueryError struct {
+	Message  string `json:"error"`
+	Token    string `json:"token"`
+	Position int    `json:"position"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d (%q)", e.Message, e.Position, e.Token)
+}
+
+type queryTokenKind int
+
+const (
+	tokenWord queryTokenKind = iota
+	tokenPhrase
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenMinus
+	tokenPlus
+	tokenLParen
+	tokenRParen
+	tokenFilter
+	tokenEOF
+)
+
+type queryToken struct {
+	kind   queryTokenKind
+	text   string // raw text as typed
+	value  string // word or phrase contents without quotes and wildcard
+	prefix bool   // trailing * wildcard
+	field  string // qualifier of a filter token, e.g. "sheet"
+	column string // header name of a column qualifier
+	quoted bool   // filter value was quoted
+	pos    int
+}
+
+func isQueryBoundary(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+}
+
+// isQualifier reports whether name before a colon makes a field qualifier.
+// Besides the known filter fields any name starting with a letter is taken
+// as a column header, so that times like 10:30 stay plain words.
+func isQualifier(name string) bool {
+	if isFilterField(strings.ToLower(name)) {
+		return true
+	}
+	for _, r := range name {
+		return unicode.IsLetter(r)
+	}
+	return false
+}
+
+// lexQualifier reads the value of a field qualifier, a bare word or a quoted
+// phrase starting at valueStart, and returns the filter token and the
+// position after it.
+func lexQualifier(runes []rune, start int, name string, valueStart int) (queryToken, int, error) {
+	tok := queryToken{kind: tokenFilter, field: strings.ToLower(name), pos: start}
+	if !isFilterField(tok.field) {
+		tok.field = FILTER_COLUMN
+		tok.column = name
+	}
+
+	end := valueStart
+	if end < len(runes) && runes[end] == '"' {
+		closing := end + 1
+		for closing < len(runes) && runes[closing] != '"' {
+			closing++
+		}
+		if closing == len(runes) {
+			return tok, 0, &QueryError{Message: "unterminated quoted phrase", Token: string(runes[end:]), Position: end}
+		}
+		tok.value = string(runes[end+1 : closing])
+		tok.quoted = true
+		end = closing + 1
+		if end < len(runes) && runes[end] == '*' {
+			tok.prefix = true
+			end++
+		}
+	} else {
+		for end < len(runes) && !isQueryBoundary(runes[end]) {
+			end++
+		}
+		tok.value = string(runes[valueStart:end])
+		// Other filters take globs, a column value only a trailing wildcard
+		if tok.field == FILTER_COLUMN && strings.HasSuffix(tok.value, "*") {
+			tok.value = strings.TrimSuffix(tok.value, "*")
+			tok.prefix = true
+		}
+	}
+
+	tok.text = string(runes[start:end])
+	if strings.TrimSpace(tok.value) == "" {
+		return tok, 0, &QueryError{Message: fmt.Sprintf("%s: needs a value", name), Token: tok.text, Position: start}
+	}
+	return tok, end, nil
+}
+
+func lexQuery(query string) ([]queryToken, error) {
+	runes := []rune(query)
+	var tokens []queryToken
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenLParen, text: "(", pos: i})
+			i++
+
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenRParen, text: ")", pos: i})
+			i++
+
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, &QueryError{Message: "unterminated quoted phrase", Token: string(runes[i:]), Position: i}
+			}
+			// A quoted column name: "Company Name":acme
+			if end+1 < len(runes) && runes[end+1] == ':' {
+				tok, next, err := lexQualifier(runes, i, string(runes[i+1:end]), end+2)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, tok)
+				i = next
+				continue
+			}
+			tok := queryToken{kind: tokenPhrase, value: string(runes[i+1 : end]), pos: i}
+			end++
+			if end < len(runes) && runes[end] == '*' {
+				tok.prefix = true
+				end++
+			}
+			tok.text = string(runes[i:end])
+			tokens = append(tokens, tok)
+			i = end
+
+		case (r == '-' || r == '+') && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && runes[i+1] != ')':
+			kind := tokenMinus
+			if r == '+' {
+				kind = tokenPlus
+			}
+			tokens = append(tokens, queryToken{kind: kind, text: string(r), pos: i})
+			i++
+
+		default:
+			end := i
+			for end < len(runes) && !isQueryBoundary(runes[end]) {
+				end++
+			}
+			text := string(runes[i:end])
+			tok := queryToken{kind: tokenWord, text: text, value: text, pos: i}
+			if name, _, ok := strings.Cut(text, ":"); ok && isQualifier(name) {
+				tok, next, err := lexQualifier(runes, i, name, i+len([]rune(name))+1)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, tok)
+				i = next
+				continue
+			}
+			switch text {
+			case "AND":
+				tok.kind = tokenAnd
+			case "OR":
+				tok.kind = tokenOr
+			case "NOT":
+				tok.kind = tokenNot
+			default:
+				if strings.HasSuffix(text, "*") {
+					tok.value = strings.TrimSuffix(text, "*")
+					tok.prefix = true
+				}
+				if star := strings.IndexRune(tok.value, '*'); star >= 0 {
+					return nil, &QueryError{
+						Message:  "wildcards are only supported at the end of a term",
+						Token:    text,
+						Position: i + len([]rune(tok.value[:star])),
+					}
+				}
+			}
+			tokens = append(tokens, tok)
+			i = end
+		}
+	}
+
+	tokens = append(tokens, queryToken{kind: tokenEOF, pos: len(runes)})
+	return tokens, nil
+}
+
+type queryNodeKind int
+
+const (
+	nodeTerm queryNodeKind = iota
+	nodeAnd
+	nodeOr
+	nodeNot
+	nodeFilter
+)
+
+// queryNode is a node of a parsed query. Terms carry the tokenized words of a
+// bare word or quoted phrase, filter nodes a field qualifier.
+type queryNode struct {
+	kind     queryNodeKind
+	words    []string
+	phrase   bool
+	prefix   bool
+	filter   searchFilter
+	children []*queryNode
+	token    queryToken
+}
+
+// parsedQuery is a search query split into the full-text part, which may be
+// nil, and the field filters applied to its matches.
+type parsedQuery struct {
+	terms   *queryNode
+	filters []searchFilter
+}
+
+type queryParser struct {
+	tokens       []queryToken
+	pos          int
+	exactAccents bool
+}
+
+// parseQuery parses a search query into a tree of terms and a list of
+// filters. Terms without any searchable characters (a lone "-" copied from
+// row content, say) are dropped; terms is nil when nothing searchable is
+// left. emailOnly says the query searches the email index, which only
+// indexes the email of each row.
+func parseQuery(query string, exactAccents, emailOnly bool) (*parsedQuery, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens, exactAccents: exactAccents}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.unexpected(tok)
+	}
+
+	parsed := &parsedQuery{}
+	var filterNodes, rest []*queryNode
+	switch {
+	case node != nil && node.kind == nodeFilter:
+		filterNodes = []*queryNode{node}
+	case node != nil && node.kind == nodeAnd:
+		for _, child := range node.children {
+			if child.kind == nodeFilter {
+				filterNodes = append(filterNodes, child)
+			} else {
+				rest = append(rest, child)
+			}
+		}
+	default:
+		rest = []*queryNode{node}
+	}
+
+	for _, filterNode := range filterNodes {
+		filter := filterNode.filter
+		parsed.filters = append(parsed.filters, filter)
+		// A column value must also appear in the row, which lets the index
+		// narrow down the rows whose cells are checked. The email index
+		// holds only the emails, so there the cells are checked alone.
+		if filter.field == FILTER_COLUMN && !filter.negate && !emailOnly {
+			rest = append(rest, &queryNode{
+				kind:   nodeTerm,
+				words:  filter.words,
+				prefix: filter.prefix,
+				token:  filterNode.token,
+			})
+		}
+	}
+	if len(rest) == 1 && rest[0] == nil {
+		rest = nil
+	}
+	node = combine(nodeAnd, rest)
+	if nested := findFilter(node); nested != nil {
+		return nil, &QueryError{
+			Message:  "field filters cannot be combined with OR or nested in groups",
+			Token:    nested.token.text,
+			Position: nested.token.pos,
+		}
+	}
+	parsed.terms = node
+	return parsed, nil
+}
+
+func findFilter(node *queryNode) *queryNode {
+	if node == nil {
+		return nil
+	}
+	if node.kind == nodeFilter {
+		return node
+	}
+	for _, child := range node.children {
+		if found := findFilter(child); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) unexpected(tok queryToken) error {
+	switch tok.kind {
+	case tokenEOF:
+		return &QueryError{Message: "unexpected end of query", Position: tok.pos}
+	case tokenRParen:
+		return &QueryError{Message: "unmatched closing parenthesis", Token: tok.text, Position: tok.pos}
+	default:
+		return &QueryError{Message: fmt.Sprintf("unexpected %s", tok.text), Token: tok.text, Position: tok.pos}
+	}
+}
+
+func (p *queryParser) parseOr() (*queryNode, error) {
+	var children []*queryNode
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			children = append(children, node)
+		}
+		if p.peek().kind != tokenOr {
+			break
+		}
+		or := p.next()
+		if kind := p.peek().kind; kind == tokenEOF || kind == tokenRParen || kind == tokenOr {
+			return nil, &QueryError{Message: "OR needs a term on its right", Token: or.text, Position: or.pos}
+		}
+	}
+	return combine(nodeOr, children), nil
+}
+
+func (p *queryParser) parseAnd() (*queryNode, error) {
+	var children []*queryNode
+	for {
+		switch p.peek().kind {
+		case tokenEOF, tokenRParen, tokenOr:
+			return combine(nodeAnd, children), nil
+		case tokenAnd:
+			and := p.next()
+			if len(children) == 0 {
+				return nil, &QueryError{Message: "AND needs a term on its left", Token: and.text, Position: and.pos}
+			}
+			if kind := p.peek().kind; kind == tokenEOF || kind == tokenRParen || kind == tokenOr || kind == tokenAnd {
+				return nil, &QueryError{Message: "AND needs a term on its right", Token: and.text, Position: and.pos}
+			}
+		}
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			children = append(children, node)
+		}
+	}
+}
+
+func (p *queryParser) parseUnary() (*queryNode, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokenNot, tokenMinus:
+		p.next()
+		if kind := p.peek().kind; kind == tokenEOF || kind == tokenRParen || kind == tokenOr || kind == tokenAnd {
+			return nil, &QueryError{Message: fmt.Sprintf("%s needs a term to exclude", tok.text), Token: tok.text, Position: tok.pos}
+		}
+		child, err := p.parseUnary()
+		if err != nil || child == nil {
+			return nil, err
+		}
+		if child.kind == nodeNot {
+			return child.children[0], nil
+		}
+		if child.kind == nodeFilter {
+			negated := *child
+			negated.filter.negate = !negated.filter.negate
+			return &negated, nil
+		}
+		return &queryNode{kind: nodeNot, children: []*queryNode{child}, token: tok}, nil
+	case tokenPlus:
+		p.next()
+		return p.parseUnary()
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (*queryNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokenRParen {
+			return nil, &QueryError{Message: "missing closing parenthesis", Token: tok.text, Position: tok.pos}
+		}
+		p.next()
+		return node, nil
+
+	case tokenWord, tokenPhrase:
+		value := tok.value
+		if !p.exactAccents {
+			value = foldText(value)
+		}
+		words := ftsTokens(value)
+		if len(words) == 0 {
+			return nil, nil
+		}
+		return &queryNode{
+			kind:  nodeTerm,
+			words: words,
+			// Bare words keep matching as prefixes, like the substring
+			// search they replace; quoted phrases match whole words
+			prefix: tok.prefix || tok.kind == tokenWord,
+			phrase: tok.kind == tokenPhrase,
+			token:  tok,
+		}, nil
+
+	case tokenFilter:
+		filter, err := newSearchFilter(tok.field, tok.value)
+		if err != nil {
+			return nil, &QueryError{Message: err.Error(), Token: tok.text, Position: tok.pos}
+		}
+		if tok.field == FILTER_COLUMN {
+			value := tok.value
+			if !p.exactAccents {
+				value = foldText(value)
+			}
+			filter.column = tok.column
+			filter.words = ftsTokens(value)
+			filter.prefix = tok.prefix || !tok.quoted
+			filter.exact = p.exactAccents
+			if len(filter.words) == 0 {
+				return nil, &QueryError{Message: "column value has no searchable characters", Token: tok.text, Position: tok.pos}
+			}
+		}
+		return &queryNode{kind: nodeFilter, filter: filter, token: tok}, nil
+	}
+	return nil, p.unexpected(tok)
+}
+
+// combine joins children with AND or OR. Groups of the same kind are
+// flattened into it, so "(-a -b) c" excludes a and b next to c.
+func combine(kind queryNodeKind, children []*queryNode) *queryNode {
+	switch len(children) {
+	case 0:
+		return nil
+	case 1:
+		return children[0]
+	}
+	var flat []*queryNode
+	for _, child := range children {
+		if child.kind == kind {
+			flat = append(flat, child.children...)
+		} else {
+			flat = append(flat, child)
+		}
+	}
+	return &queryNode{kind: kind, children: flat}
+}
+
+// compileQuery compiles the full-text part of query, parsed into parsed, to
+// search together with filters. match is empty when the filters alone
+// select the rows; exclude is set when match gives the rows to leave out of
+// those the filters select.
+func compileQuery(query string, parsed *parsedQuery, filters []searchFilter) (match string, exclude bool, err error) {
+	if parsed.terms == nil {
+		if len(filters) == 0 {
+			return "", false, &QueryError{Message: "query has no searchable terms", Token: query}
+		}
+		return "", false, nil
+	}
+
+	match, exclude, err = compileTerms(parsed.terms)
+	if err != nil {
+		return "", false, err
+	}
+	if exclude && !hasPositiveFilter(filters) {
+		first := parsed.terms
+		if first.kind == nodeAnd {
+			first = first.children[0]
+		}
+		return "", false, &QueryError{
+			Message:  "a query cannot only exclude terms; add a term or filter to search for",
+			Token:    first.token.text,
+			Position: first.token.pos,
+		}
+	}
+	return match, exclude, nil
+}
+
+// compileTerms compiles the full-text part of a query. A query that only
+// excludes terms cannot be expressed in FTS on its own; for those the
+// expression matching any excluded term is returned with exclude set, so the
+// caller can filter out its matches from rows selected by field filters.
+func compileTerms(node *queryNode) (match string, exclude bool, err error) {
+	var excluded []*queryNode
+	switch {
+	case node.kind == nodeNot:
+		excluded = []*queryNode{node}
+	case node.kind == nodeAnd:
+		for _, child := range node.children {
+			if child.kind != nodeNot {
+				excluded = nil
+				break
+			}
+			excluded = append(excluded, child)
+		}
+	}
+	if len(excluded) == 0 {
+		match, err = compileMatch(node)
+		return match, false, err
+	}
+
+	parts := make([]string, 0, len(excluded))
+	for _, not := range excluded {
+		part, err := compileMatch(not.children[0])
+		if err != nil {
+			return "", false, err
+		}
+		parts = append(parts, part)
+	}
+	return "(" + strings.Join(parts, " OR ") + ")", true, nil
+}
+
+// compileMatch renders a query tree in FTS4 enhanced query syntax. FTS only
+// has a binary NOT, so negated terms must sit next to a positive term in an
+// AND group and cannot appear on their own or inside OR.
+func compileMatch(node *queryNode) (string, error) {
+	switch node.kind {
+	case nodeTerm:
+		expr := strings.Join(node.words, " ")
+		if node.prefix {
+			expr += "*"
+		}
+		if len(node.words) > 1 {
+			expr = `"` + expr + `"`
+		}
+		return expr, nil
+
+	case nodeNot:
+		return "", &QueryError{
+			Message:  "a query cannot only exclude terms; add a term to search for",
+			Token:    node.token.text,
+			Position: node.token.pos,
+		}
+
+	case nodeOr:
+		parts := make([]string, 0, len(node.children))
+		for _, child := range node.children {
+			if child.kind == nodeNot {
+				return "", &QueryError{
+					Message:  "excluded terms cannot be combined with OR",
+					Token:    child.token.text,
+					Position: child.token.pos,
+				}
+			}
+			part, err := compileMatch(child)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		return "(" + strings.Join(parts, " OR ") + ")", nil
+
+	case nodeAnd:
+		var positives, negatives []string
+		var firstNot *queryNode
+		for _, child := range node.children {
+			if child.kind == nodeNot {
+				if firstNot == nil {
+					firstNot = child
+				}
+				part, err := compileMatch(child.children[0])
+				if err != nil {
+					return "", err
+				}
+				negatives = append(negatives, part)
+				continue
+			}
+			part, err := compileMatch(child)
+			if err != nil {
+				return "", err
+			}
+			positives = append(positives, part)
+		}
+		if len(positives) == 0 {
+			return compileMatch(firstNot)
+		}
+
+		expr := strings.Join(positives, " AND ")
+		if len(positives) > 1 && len(negatives) > 0 {
+			expr = "(" + expr + ")"
+		}
+		for _, negative := range negatives {
+			expr += " NOT " + negative
+		}
+		return "(" + expr + ")", nil
+	}
+	return "", fmt.Errorf("unknown query node %d", node.kind)
+}
+
+// positiveTerms returns the terms of a query that a matching row contains,
+// leaving out excluded ones.
+func positiveTerms(node *queryNode) []*queryNode {
+	if node == nil {
+		return nil
+	}
+	switch node.kind {
+	case nodeTerm:
+		return []*queryNode{node}
+	case nodeNot, nodeFilter:
+		return nil
+	}
+	var terms []*queryNode
+	for _, child := range node.children {
+		terms = append(terms, positiveTerms(child)...)
+	}
+	return terms
+}
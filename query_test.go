@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// filterString describes a filter compactly for comparisons.
+func filterString(f searchFilter) string {
+	var s string
+	switch f.field {
+	case FILTER_COLUMN:
+		s = f.column + "=" + strings.Join(f.words, " ")
+		if f.prefix {
+			s += "*"
+		}
+	case FILTER_ROW:
+		s = fmt.Sprintf("row:%d-%d", f.rowFrom, f.rowTo)
+	default:
+		s = f.field + ":" + f.value
+	}
+	if f.negate {
+		s = "-" + s
+	}
+	return s
+}
+
+func TestCompileQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		emailOnly bool
+		match     string
+		exclude   bool
+		filters   []string
+	}{
+		// Bare words match as prefixes, folded
+		{query: "nguyen", match: "nguyen*"},
+		{query: "Nguyễn HANOI", match: "(nguyen* AND hanoi*)"},
+		{query: "+acme", match: "acme*"},
+		{query: "acme AND globex", match: "(acme* AND globex*)"},
+
+		// OR and NOT
+		{query: "acme OR globex", match: "(acme* OR globex*)"},
+		{query: "acme OR globex OR initech", match: "(acme* OR globex* OR initech*)"},
+		{query: "acme NOT test", match: "(acme* NOT test*)"},
+		{query: "-test acme", match: "(acme* NOT test*)"},
+		{query: "a b -c -d", match: "((a* AND b*) NOT c* NOT d*)"},
+		{query: "acme --test", match: "(acme* AND test*)"},
+
+		// Phrases
+		{query: `"nguyen van an"`, match: `"nguyen van an"`},
+		{query: `"nguyen van"*`, match: `"nguyen van*"`},
+		{query: `"acme"`, match: "acme"},
+		{query: `acme -"test data"`, match: `(acme* NOT "test data")`},
+
+		// Grouping
+		{query: "(acme OR globex) -test", match: "((acme* OR globex*) NOT test*)"},
+		{query: "(a OR (b c)) d", match: "((a* OR (b* AND c*)) AND d*)"},
+		{query: "((a b)) c", match: "(a* AND b* AND c*)"},
+		{query: "(a OR b) OR c", match: "(a* OR b* OR c*)"},
+		{query: "(-a -b) c", match: "(c* NOT a* NOT b*)"},
+
+		// Terms without searchable characters are dropped
+		{query: "acme - globex", match: "(acme* AND globex*)"},
+
+		// Filters
+		{query: "acme sheet:Customers", match: "acme*", filters: []string{"sheet:Customers"}},
+		{query: `-sheet:"Old Data" acme`, match: "acme*", filters: []string{"-sheet:Old Data"}},
+		{query: "row:10-20", filters: []string{"row:10-20"}},
+		{query: "-a -b sheet:X", match: "(a* OR b*)", exclude: true, filters: []string{"sheet:X"}},
+
+		// Column values narrow the full-text search, except in the email
+		// index, which holds only emails
+		{query: "Phone:0903*", match: "0903*", filters: []string{"Phone=0903*"}},
+		{query: `nguyen "Company Name":"acme corp"`, match: `(nguyen* AND "acme corp")`, filters: []string{`Company Name=acme corp`}},
+		{query: "-Phone:0903 acme", match: "acme*", filters: []string{"-Phone=0903*"}},
+		{query: "Name:nguyen", emailOnly: true, filters: []string{"Name=nguyen*"}},
+		{query: "gmail Name:nguyen", emailOnly: true, match: "gmail*", filters: []string{"Name=nguyen*"}},
+
+		// Times are words, not qualifiers
+		{query: "10:30", match: `"10 30*"`},
+	}
+
+	for _, test := range tests {
+		parsed, err := parseQuery(test.query, false, test.emailOnly)
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", test.query, err)
+			continue
+		}
+		match, exclude, err := compileQuery(test.query, parsed, parsed.filters)
+		if err != nil {
+			t.Errorf("compileQuery(%q): %v", test.query, err)
+			continue
+		}
+		if match != test.match || exclude != test.exclude {
+			t.Errorf("compileQuery(%q) = %q, exclude %v; want %q, exclude %v", test.query, match, exclude, test.match, test.exclude)
+		}
+		var filters []string
+		for _, f := range parsed.filters {
+			filters = append(filters, filterString(f))
+		}
+		if !reflect.DeepEqual(filters, test.filters) {
+			t.Errorf("filters of %q = %q; want %q", test.query, filters, test.filters)
+		}
+	}
+}
+
+func TestCompileQueryErrors(t *testing.T) {
+	tests := []struct {
+		query    string
+		message  string
+		position int
+	}{
+		{`acme "unterminated`, "unterminated quoted phrase", 5},
+		{`"Company Name:acme`, "unterminated quoted phrase", 0},
+		{"-", "query has no searchable terms", 0},
+		{"-test", "a query cannot only exclude terms", 0},
+		{"-a -b", "a query cannot only exclude terms", 0},
+		{"NOT acme", "a query cannot only exclude terms", 0},
+		{"(-a -b) OR c", "a query cannot only exclude terms", 1},
+		{"acme OR sheet:X", "field filters cannot be combined with OR", 8},
+		{"(acme OR sheet:X) b", "field filters cannot be combined with OR", 9},
+		{"acme OR -test", "excluded terms cannot be combined with OR", 8},
+		{"acme NOT", "NOT needs a term to exclude", 5},
+		{"acme -)", "unmatched closing parenthesis", 6},
+		{"(acme globex", "missing closing parenthesis", 0},
+		{"acme)", "unmatched closing parenthesis", 4},
+		{"acme OR", "OR needs a term on its right", 5},
+		{"AND acme", "AND needs a term on its left", 0},
+		{"acme AND", "AND needs a term on its right", 5},
+		{"ac*me", "wildcards are only supported at the end of a term", 2},
+		{"row:ten", "row: expects a row number", 0},
+		{"sheet:", "sheet: needs a value", 0},
+		{"Phone:-", "column value has no searchable characters", 0},
+	}
+
+	for _, test := range tests {
+		parsed, err := parseQuery(test.query, false, false)
+		if err == nil {
+			_, _, err = compileQuery(test.query, parsed, parsed.filters)
+		}
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("%q: got error %v; want a QueryError", test.query, err)
+			continue
+		}
+		if !strings.Contains(queryErr.Message, test.message) || queryErr.Position != test.position {
+			t.Errorf("%q: got %q at %d; want %q at %d", test.query, queryErr.Message, queryErr.Position, test.message, test.position)
+		}
+	}
+}
+
+func TestCompileQueryExcludeWithRequestFilters(t *testing.T) {
+	parsed, err := parseQuery("-test", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := requestFilters(SearchFilters{Sheet: "Customers"})
+	match, exclude, err := compileQuery("-test", parsed, filters)
+	if err != nil || match != "(test*)" || !exclude {
+		t.Errorf("compileQuery(-test) with a sheet filter = %q, %v, %v; want \"(test*)\", true, nil", match, exclude, err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Document formats are read by the Reader registered for their extensions.
+// A file is read by the format of its extension, unless its first bytes
+// carry the signature of another registered format, e.g. an XLSX workbook
+// saved as .xls. Imports asking for extensions no format is registered for
+// are rejected before they start.
+
+// Reader reads the rows of the documents of one format.
+type Reader interface {
+	// Read calls emit with every data row of the file at path, stopping at
+	// the first error emit returns
+	Read(path string, options ReadOptions, emit func(sheetRow) error) error
+}
+
+// ReadOptions are the settings of an import that change how files are read.
+// Readers ignore the options of other formats.
+type ReadOptions struct {
+	CSV CSVOptions
+}
+
+// readerFunc adapts a function to Reader.
+type readerFunc func(path string, options ReadOptions, emit func(sheetRow) error) error
+
+func (f readerFunc) Read(path string, options ReadOptions, emit func(sheetRow) error) error {
+	return f(path, options, emit)
+}
+
+// ignoreOptions adapts a reader without options to Reader.
+func ignoreOptions(read func(path string, emit func(sheetRow) error) error) Reader {
+	return readerFunc(func(path string, _ ReadOptions, emit func(sheetRow) error) error {
+		return read(path, emit)
+	})
+}
+
+// documentFormat is a registered document format.
+type documentFormat struct {
+	name string
+	// extensions are lower case, without the dot
+	extensions []string
+	// sniff reports whether a file starting with head has the signature of
+	// this format, which formats stored in the same container share, like
+	// XLSX, ODS and ZIP files, all zip archives. It is nil for formats
+	// without a signature, like CSV.
+	sniff  func(head []byte) bool
+	reader Reader
+	// archive is set for formats holding files of other formats
+	archive bool
+}
+
+// SNIFF_LEN is how many bytes of a file are read to recognize its format.
+const SNIFF_LEN = 512
+
+// documentFormats are the registered formats, in registration order.
+var documentFormats []*documentFormat
+
+// registerFormat makes the extensions of f importable.
+func registerFormat(f documentFormat) {
+	for _, ext := range f.extensions {
+		if formatForExtension(ext) != nil {
+			panic(fmt.Sprintf("extension %q registered twice", ext))
+		}
+	}
+	documentFormats = append(documentFormats, &f)
+}
+
+func init() {
+	registerFormat(documentFormat{
+		name:       "XLSX",
+		extensions: []string{"xlsx"},
+		sniff:      isZip,
+		reader:     ignoreOptions(readXLSXFile),
+	})
+	registerFormat(documentFormat{
+		name:       "ODS",
+		extensions: []string{"ods"},
+		sniff:      isZip,
+		reader:     ignoreOptions(readODSFile),
+	})
+	registerFormat(documentFormat{
+		name:       "XLS",
+		extensions: []string{"xls"},
+		sniff:      isOLE2,
+		reader:     ignoreOptions(readXLSFile),
+	})
+	registerFormat(documentFormat{
+		name:       "CSV",
+		extensions: []string{"csv"},
+		reader:     readerFunc(readCSVFile),
+	})
+	registerFormat(documentFormat{
+		name:       "ZIP",
+		extensions: []string{"zip"},
+		sniff:      isZip,
+		reader:     readerFunc(readZipArchive),
+		archive:    true,
+	})
+	registerFormat(documentFormat{
+		name:       "GZIP",
+		extensions: []string{"gz", "tgz"},
+		sniff:      isGzip,
+		reader:     readerFunc(readGzipArchive),
+		archive:    true,
+	})
+}
+
+// isZip reports whether head starts a zip archive.
+func isZip(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04"))
+}
+
+// isOLE2 reports whether head starts an OLE2 compound file, as XLS
+// workbooks are.
+func isOLE2(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"))
+}
+
+// normalizeExtension returns ext in lower case without a leading dot.
+func normalizeExtension(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+}
+
+// formatForExtension returns the format registered for ext, or nil.
+func formatForExtension(ext string) *documentFormat {
+	ext = normalizeExtension(ext)
+	for _, f := range documentFormats {
+		for _, e := range f.extensions {
+			if e == ext {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// supportedExtensions lists the extensions of every registered format.
+func supportedExtensions() []string {
+	var extensions []string
+	for _, f := range documentFormats {
+		extensions = append(extensions, f.extensions...)
+	}
+	return extensions
+}
+
+// validateExtensions rejects extensions no format is registered for. Blank
+// entries are ignored.
+func validateExtensions(extensions []string) error {
+	var unsupported []string
+	for _, ext := range extensions {
+		if normalizeExtension(ext) != "" && formatForExtension(ext) == nil {
+			unsupported = append(unsupported, ext)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("unsupported file type %s; supported types are %s",
+			strings.Join(unsupported, ", "), strings.Join(supportedExtensions(), ", "))
+	}
+	return nil
+}
+
+// formatForFile returns the format to read the file at path with, whose
+// extension is ext. The extension decides, unless the file has the
+// signature of another container: a zip archive named .xls is read as XLSX,
+// while an ODS named .ods is read as ODS whatever its first entry.
+func formatForFile(path, ext string) (*documentFormat, error) {
+	format := formatForExtension(ext)
+	if format == nil {
+		return nil, fmt.Errorf("unsupported file type %q", ext)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	head := make([]byte, SNIFF_LEN)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	if format.sniff != nil && format.sniff(head) {
+		return format, nil
+	}
+	for _, f := range documentFormats {
+		if f != format && f.sniff != nil && f.sniff(head) {
+			return f, nil
+		}
+	}
+	return format, nil
+}
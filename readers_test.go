@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatForFile(t *testing.T) {
+	dir := t.TempDir()
+	content := odsContent("")
+	odsFirst := writeODS(t, dir, "first.ods", content, true)
+	odsLater := writeODS(t, dir, "later.ods", content, false)
+	zipBytes, err := os.ReadFile(odsLater)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ole2 := "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1" + string(make([]byte, 504))
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		path   string
+		ext    string
+		format string
+	}{
+		{odsFirst, "ods", "ODS"},
+		// The mimetype entry should come first, but not all writers do so
+		{odsLater, "ods", "ODS"},
+		{write("book.xlsx", string(zipBytes)), "xlsx", "XLSX"},
+		{write("drop.zip", string(zipBytes)), "zip", "ZIP"},
+		{write("data.csv", "Name,City\nAn,Hanoi\n"), "csv", "CSV"},
+		{write("old.xls", ole2), "xls", "XLS"},
+
+		// A signature of another container overrides the extension
+		{write("renamed.xls", string(zipBytes)), "xls", "XLSX"},
+		{write("renamed.xlsx", ole2), "xlsx", "XLS"},
+		{write("export.csv", ole2), "csv", "XLS"},
+		{write("data.csv.gz", "\x1F\x8B\x08\x00"), "gz", "GZIP"},
+
+		// Without a signature the extension decides
+		{write("text.xls", "Name\tCity\n"), "xls", "XLS"},
+		{write("empty.xlsx", ""), "xlsx", "XLSX"},
+	}
+	for _, test := range tests {
+		format, err := formatForFile(test.path, test.ext)
+		if err != nil {
+			t.Errorf("%s: %v", filepath.Base(test.path), err)
+			continue
+		}
+		if format.name != test.format {
+			t.Errorf("%s read as %s; want %s", filepath.Base(test.path), format.name, test.format)
+		}
+	}
+
+	if _, err := formatForFile(write("notes.txt", "text"), "txt"); err == nil {
+		t.Error("notes.txt has a format; want an unsupported file type error")
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every database keeps a registry of the files imported into it, in the files
+// table, and a history of import runs, in the imports table. A file's row
+// points at the run that last imported it.
+
+// Import status of a file in the files table
+const (
+	FILE_IMPORTED = "imported"
+	FILE_FAILED   = "failed"
+)
+
+// MAX_IMPORT_RUNS is how many runs GET /imports returns by default.
+const MAX_IMPORT_RUNS = 50
+
+// FileRecord is a file's entry in the files table. Size, ModTime, Hash,
+// RowCount and the skipped rows describe the file as it was last imported
+// successfully; a failed import only updates Status, Error and ImportedAt.
+type FileRecord struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	Hash       string    `json:"hash"`
+	RowCount   int       `json:"rowCount"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	ImportedAt time.Time `json:"importedAt"`
+	ImportID   int64     `json:"importId"`
+	// RowsSkipped counts the rows that could not be read; RowErrors has the
+	// first MAX_ROW_ERRORS of them
+	RowsSkipped int        `json:"rowsSkipped,omitempty"`
+	RowErrors   []RowError `json:"rowErrors,omitempty"`
+}
+
+// ImportRun is a row of the imports table, one per call of importToSQLite.
+type ImportRun struct {
+	ID           int64      `json:"id"`
+	JobID        string     `json:"jobId,omitempty"`
+	Kind         string     `json:"kind"`
+	Schedule     string     `json:"schedule,omitempty"`
+	Status       string     `json:"status"`
+	FilesTotal   int        `json:"filesTotal"`
+	FilesDone    int        `json:"filesDone"`
+	FilesFailed  int        `json:"filesFailed"`
+	FilesSkipped int        `json:"filesSkipped"`
+	RowsInserted int        `json:"rowsInserted"`
+	Message      string     `json:"message,omitempty"`
+	StartedAt    time.Time  `json:"startedAt"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+}
+
+// createRegistryTables creates the files and imports tables. When the files
+// table is new, files already in contentTable are registered from their rows
+// so that databases from older versions report them too; their size, time
+// and hash stay unknown until they are imported again.
+func createRegistryTables(database querier, contentTable string) error {
+	var existing int
+	err := database.QueryRow(`
+		SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'files'
+	`).Scan(&existing)
+	if err != nil {
+		return fmt.Errorf("error checking files table: %v", err)
+	}
+
+	_, err = database.Exec(`
+		CREATE TABLE IF NOT EXISTS imports (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			job_id TEXT,
+			kind TEXT,
+			schedule TEXT DEFAULT '',
+			status TEXT,
+			files_total INTEGER DEFAULT 0,
+			files_done INTEGER DEFAULT 0,
+			files_failed INTEGER DEFAULT 0,
+			files_skipped INTEGER DEFAULT 0,
+			rows_inserted INTEGER DEFAULT 0,
+			message TEXT,
+			started_at TIMESTAMP,
+			finished_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS files (
+			path TEXT PRIMARY KEY,
+			size INTEGER DEFAULT 0,
+			mtime TIMESTAMP,
+			hash TEXT DEFAULT '',
+			row_count INTEGER DEFAULT 0,
+			status TEXT,
+			error TEXT DEFAULT '',
+			imported_at TIMESTAMP,
+			import_id INTEGER DEFAULT 0
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_files_import ON files(import_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating file registry tables: %v", err)
+	}
+
+	if err := addColumnIfMissing(database, "imports", "files_skipped", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(database, "imports", "schedule", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+
+	if existing == 0 {
+		_, err = database.Exec(fmt.Sprintf(`
+			INSERT OR IGNORE INTO files (path, row_count, status)
+			SELECT file, COUNT(*), ? FROM %s GROUP BY file
+		`, contentTable), FILE_IMPORTED)
+		if err != nil {
+			return fmt.Errorf("error registering imported files: %v", err)
+		}
+	}
+	return nil
+}
+
+// fingerprintFile returns the size, modification time and SHA-256 hash of
+// the file at path.
+func fingerprintFile(path string) (FileRecord, error) {
+	record := FileRecord{Path: path}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return record, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return record, err
+	}
+	record.Size = info.Size()
+	record.ModTime = info.ModTime()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return record, fmt.Errorf("error hashing file %s: %v", path, err)
+	}
+	record.Hash = hex.EncodeToString(hash.Sum(nil))
+	return record, nil
+}
+
+// checkFileChanged compares the file at path with its last successful
+// import. The file is unchanged when its size and modification time are the
+// same, or, if only the time differs, when its content hash is the same, in
+// which case the registered time is updated. The file is only hashed when
+// needed; the returned record has the hash unless the file is unchanged.
+func checkFileChanged(database *sql.DB, path string) (FileRecord, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileRecord{Path: path}, false, err
+	}
+
+	previous, err := lookupFile(database, path)
+	if err != nil {
+		return FileRecord{Path: path}, false, err
+	}
+	imported := previous != nil && previous.Status == FILE_IMPORTED && previous.Hash != ""
+	if imported && previous.Size == info.Size() && previous.ModTime.Equal(info.ModTime()) {
+		return *previous, true, nil
+	}
+
+	record, err := fingerprintFile(path)
+	if err != nil {
+		return record, false, err
+	}
+	if !imported || previous.Hash != record.Hash {
+		return record, false, nil
+	}
+
+	_, err = database.Exec("UPDATE files SET size = ?, mtime = ? WHERE path = ?", record.Size, record.ModTime, path)
+	if err != nil {
+		return record, false, fmt.Errorf("error updating file %s: %v", path, err)
+	}
+	return record, true, nil
+}
+
+// recordImportedFile registers a successful import of record.Path within the
+// transaction that wrote its rows. The row count, including the rows of
+// archive members, is read back from contentTable, so it stays right when a
+// file is appended more than once.
+func recordImportedFile(tx *sql.Tx, contentTable string, record FileRecord) error {
+	err := tx.QueryRow("SELECT COUNT(*) FROM "+contentTable+" WHERE "+FILE_ROWS_CONDITION, fileRowsArgs(record.Path)...).Scan(&record.RowCount)
+	if err != nil {
+		return fmt.Errorf("error counting rows for %s: %v", record.Path, err)
+	}
+
+	rowErrors := ""
+	if len(record.RowErrors) > 0 {
+		data, _ := json.Marshal(record.RowErrors)
+		rowErrors = string(data)
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO files (path, size, mtime, hash, row_count, rows_skipped, row_errors, status, error, imported_at, import_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', ?, ?)
+	`, record.Path, record.Size, record.ModTime, record.Hash, record.RowCount, record.RowsSkipped, rowErrors,
+		FILE_IMPORTED, time.Now(), record.ImportID)
+	if err != nil {
+		return fmt.Errorf("error registering file %s: %v", record.Path, err)
+	}
+	return nil
+}
+
+// addRowErrorColumns adds the columns recording the rows of a file that
+// could not be read to the files table.
+func addRowErrorColumns(database querier) error {
+	if err := addColumnIfMissing(database, "files", "rows_skipped", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(database, "files", "row_errors", "TEXT DEFAULT ''")
+}
+
+// recordFailedFile registers a failed import of path. What is known about
+// the file's last successful import is kept.
+func recordFailedFile(database *sql.DB, path string, importID int64, importErr error) error {
+	_, err := database.Exec(`
+		INSERT INTO files (path, status, error, imported_at, import_id)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET
+			status = excluded.status,
+			error = excluded.error,
+			imported_at = excluded.imported_at,
+			import_id = excluded.import_id
+	`, path, FILE_FAILED, importErr.Error(), time.Now(), importID)
+	if err != nil {
+		return fmt.Errorf("error registering file %s: %v", path, err)
+	}
+	return nil
+}
+
+// beginImportRun inserts run into the imports table and sets its ID.
+func beginImportRun(database *sql.DB, run *ImportRun) error {
+	run.Status = JOB_RUNNING
+	run.StartedAt = time.Now()
+	result, err := database.Exec(`
+		INSERT INTO imports (job_id, kind, schedule, status, files_total, started_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, run.JobID, run.Kind, run.Schedule, run.Status, run.FilesTotal, run.StartedAt)
+	if err != nil {
+		return fmt.Errorf("error recording import run: %v", err)
+	}
+	run.ID, err = result.LastInsertId()
+	return err
+}
+
+// finishImportRun records the outcome of run.
+func finishImportRun(database *sql.DB, run *ImportRun) error {
+	now := time.Now()
+	run.FinishedAt = &now
+	_, err := database.Exec(`
+		UPDATE imports
+		SET status = ?, files_done = ?, files_failed = ?, files_skipped = ?, rows_inserted = ?, message = ?, finished_at = ?
+		WHERE id = ?
+	`, run.Status, run.FilesDone, run.FilesFailed, run.FilesSkipped, run.RowsInserted, run.Message, now, run.ID)
+	if err != nil {
+		return fmt.Errorf("error recording import run %d: %v", run.ID, err)
+	}
+	return nil
+}
+
+// listImportRuns returns the latest runs, newest first, only those started by
+// the named schedule unless schedule is empty.
+func listImportRuns(database *sql.DB, schedule string, limit int) ([]ImportRun, error) {
+	rows, err := database.Query(`
+		SELECT id, coalesce(job_id, ''), coalesce(kind, ''), coalesce(schedule, ''), coalesce(status, ''),
+			files_total, files_done, files_failed, files_skipped, rows_inserted, coalesce(message, ''),
+			started_at, finished_at
+		FROM imports
+		WHERE ? = '' OR schedule = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, schedule, schedule, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing import runs: %v", err)
+	}
+	defer rows.Close()
+
+	runs := []ImportRun{}
+	for rows.Next() {
+		var run ImportRun
+		var finishedAt sql.NullTime
+		err := rows.Scan(&run.ID, &run.JobID, &run.Kind, &run.Schedule, &run.Status,
+			&run.FilesTotal, &run.FilesDone, &run.FilesFailed, &run.FilesSkipped, &run.RowsInserted, &run.Message,
+			&run.StartedAt, &finishedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error reading import runs: %v", err)
+		}
+		if finishedAt.Valid {
+			run.FinishedAt = &finishedAt.Time
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// fileRecordColumns are the columns of the files table read by
+// scanFileRecord.
+const fileRecordColumns = "path, size, mtime, hash, row_count, rows_skipped, row_errors, status, error, imported_at, import_id"
+
+// rowScanner is a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFileRecord(row rowScanner) (FileRecord, error) {
+	var record FileRecord
+	var modTime, importedAt sql.NullTime
+	var rowErrors string
+	err := row.Scan(&record.Path, &record.Size, &modTime, &record.Hash, &record.RowCount,
+		&record.RowsSkipped, &rowErrors, &record.Status, &record.Error, &importedAt, &record.ImportID)
+	record.ModTime = modTime.Time
+	record.ImportedAt = importedAt.Time
+	if err == nil && rowErrors != "" {
+		if jsonErr := json.Unmarshal([]byte(rowErrors), &record.RowErrors); jsonErr != nil {
+			log.Printf("Warning: Could not read row errors of %s: %v", record.Path, jsonErr)
+		}
+	}
+	return record, err
+}
+
+// lookupFile returns the registry entry of path, or nil if it has none.
+func lookupFile(database *sql.DB, path string) (*FileRecord, error) {
+	record, err := scanFileRecord(database.QueryRow(
+		"SELECT "+fileRecordColumns+" FROM files WHERE path = ?", path))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error checking file %s: %v", path, err)
+	}
+	return &record, nil
+}
+
+// listFiles returns the registered files whose path starts with prefix,
+// sorted by path.
+func listFiles(database *sql.DB, prefix string) ([]FileRecord, error) {
+	rows, err := database.Query(`
+		SELECT `+fileRecordColumns+` FROM files
+		WHERE substr(path, 1, length(?)) = ?
+		ORDER BY path
+	`, prefix, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing files: %v", err)
+	}
+	defer rows.Close()
+
+	records := []FileRecord{}
+	for rows.Next() {
+		record, err := scanFileRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error listing files: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// registeredFilesUnder returns the registered files inside dir.
+func registeredFilesUnder(database *sql.DB, dir string) ([]string, error) {
+	return registeredFilesWithPrefix(database, strings.TrimRight(dir, `/\`)+string(filepath.Separator))
+}
+
+// registeredFilesWithPrefix returns the registered files whose path starts
+// with prefix.
+func registeredFilesWithPrefix(database *sql.DB, prefix string) ([]string, error) {
+	return queryPaths(database, `
+		SELECT path FROM files WHERE substr(path, 1, length(?)) = ?
+	`, prefix, prefix)
+}
+
+// registeredFilesOfImport returns the files whose rows were last imported by
+// the import run with the given ID.
+func registeredFilesOfImport(database *sql.DB, importID int64) ([]string, error) {
+	return queryPaths(database, `
+		SELECT path FROM files WHERE import_id = ? AND status = ?
+	`, importID, FILE_IMPORTED)
+}
+
+func queryPaths(database *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := database.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error listing files: %v", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("error listing files: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// removeFile deletes the rows, headers and registry entry of path in one
+// transaction and returns the number of rows deleted.
+func removeFile(database *sql.DB, emailOnly bool, path string) (int64, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction for %s: %v", path, err)
+	}
+	defer tx.Rollback()
+
+	rows, err := deleteFileRows(tx, emailOnly, path)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM files WHERE path = ?", path); err != nil {
+		return 0, fmt.Errorf("error unregistering file %s: %v", path, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing transaction for %s: %v", path, err)
+	}
+	return rows, nil
+}
+
+// countFiles returns how many registered files are imported and how many
+// failed their last import.
+func countFiles(database *sql.DB) (int, int, error) {
+	var imported, failed int
+	err := database.QueryRow(`
+		SELECT
+			coalesce(SUM(status = ?), 0),
+			coalesce(SUM(status = ?), 0)
+		FROM files
+	`, FILE_IMPORTED, FILE_FAILED).Scan(&imported, &failed)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error counting files: %v", err)
+	}
+	return imported, failed, nil
+}
+
+// importsHandler serves GET /imports, the latest import runs of the main
+// database, or of the email database with ?emailOnly=true. ?limit= changes
+// how many are returned and ?schedule= keeps the runs of one schedule.
+func (h *handlers) importsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	emailOnly, _ := strconv.ParseBool(r.URL.Query().Get("emailOnly"))
+	database := h.store.database(emailOnly)
+	limit := MAX_IMPORT_RUNS
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+
+	runs, err := listImportRuns(database, r.URL.Query().Get("schedule"), limit)
+	if err != nil {
+		log.Printf("Error listing import runs: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// RemoveFilesResponse reports what DELETE /files removed from the index.
+type RemoveFilesResponse struct {
+	FilesRemoved int      `json:"filesRemoved"`
+	RowsRemoved  int64    `json:"rowsRemoved"`
+	Files        []string `json:"files"`
+}
+
+// removeFiles removes every file of paths from the index, stopping at the
+// first error.
+func removeFiles(database *sql.DB, emailOnly bool, paths []string) (RemoveFilesResponse, error) {
+	resp := RemoveFilesResponse{Files: []string{}}
+	for _, path := range paths {
+		rows, err := removeFile(database, emailOnly, path)
+		if err != nil {
+			return resp, err
+		}
+		resp.FilesRemoved++
+		resp.RowsRemoved += rows
+		resp.Files = append(resp.Files, path)
+	}
+	return resp, nil
+}
+
+// filesHandler serves /files for the main database, or the email database
+// with ?emailOnly=true.
+//
+// GET lists the registered files, only those starting with ?prefix= when
+// given. DELETE removes the rows, headers and registry entries of the file
+// ?path=, of the files starting with ?prefix=, or of the files last imported
+// by the run ?importId=, and reports how many files and rows were removed.
+func (h *handlers) filesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	emailOnly, _ := strconv.ParseBool(query.Get("emailOnly"))
+	database := h.store.database(emailOnly)
+
+	switch r.Method {
+	case http.MethodGet:
+		records, err := listFiles(database, query.Get("prefix"))
+		if err != nil {
+			log.Printf("Error listing files: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+
+	case http.MethodDelete:
+		path, prefix, importID := query.Get("path"), query.Get("prefix"), query.Get("importId")
+		given := 0
+		for _, value := range []string{path, prefix, importID} {
+			if value != "" {
+				given++
+			}
+		}
+		if given != 1 {
+			http.Error(w, "Exactly one of path, prefix or importId is required", http.StatusBadRequest)
+			return
+		}
+
+		var paths []string
+		var err error
+		switch {
+		case path != "":
+			paths = []string{path}
+		case prefix != "":
+			paths, err = registeredFilesWithPrefix(database, prefix)
+		default:
+			id, parseErr := strconv.ParseInt(importID, 10, 64)
+			if parseErr != nil {
+				http.Error(w, "Invalid importId", http.StatusBadRequest)
+				return
+			}
+			paths, err = registeredFilesOfImport(database, id)
+		}
+		if err != nil {
+			log.Printf("Error removing files: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var record *FileRecord
+		if path != "" {
+			if record, err = lookupFile(database, path); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resp, err := removeFiles(database, emailOnly, paths)
+		if err != nil {
+			log.Printf("Error removing files: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if path != "" && record == nil && resp.RowsRemoved == 0 {
+			http.Error(w, "File not found in the index", http.StatusNotFound)
+			return
+		}
+		log.Printf("Removed %d files and %d rows from the index", resp.FilesRemoved, resp.RowsRemoved)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
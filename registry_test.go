@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// importTestFiles imports files into store in mode and returns the run. A
+// failed import is returned too, with its outcome in the run.
+func importTestFiles(t *testing.T, store *Store, mode string, files ...string) *ImportRun {
+	run := &ImportRun{Kind: JOB_IMPORT}
+	req := ImportRequest{Files: files, Extensions: []string{"csv"}, Mode: mode}
+	if err := importToSQLite(context.Background(), store, req, run, importProgress{}); err != nil {
+		t.Logf("import in mode %q: %v", mode, err)
+	}
+	return run
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckFileChanged(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir)
+	path := filepath.Join(dir, "customers.csv")
+	writeTestFile(t, path, "Name,City\nAn,Hà Nội\nBình,Huế\n")
+
+	// A file never imported is changed
+	record, unchanged, err := checkFileChanged(store.db, path)
+	if err != nil || unchanged || record.Hash == "" {
+		t.Fatalf("before import: %+v, %v, %v; want changed with a hash", record, unchanged, err)
+	}
+
+	importTestFiles(t, store, IMPORT_INCREMENTAL, path)
+	if _, unchanged, err := checkFileChanged(store.db, path); err != nil || !unchanged {
+		t.Errorf("after import: unchanged %v, %v; want unchanged", unchanged, err)
+	}
+
+	// A newer modification time alone is checked against the hash, and
+	// registered so the file is not hashed again next time
+	touched := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	if _, unchanged, err := checkFileChanged(store.db, path); err != nil || !unchanged {
+		t.Errorf("after touch: unchanged %v, %v; want unchanged", unchanged, err)
+	}
+	previous, err := lookupFile(store.db, path)
+	if err != nil || previous == nil || !previous.ModTime.Equal(touched) {
+		t.Errorf("registered %+v, %v; want the modification time %v", previous, err, touched)
+	}
+
+	// Content rewritten at the same size and modification time is not
+	// hashed, while a new modification time reveals it with its new hash
+	writeTestFile(t, path, "Name,City\nAn,Hà Nội\nBính,Huế\n")
+	if err := os.Chtimes(path, touched, touched); err != nil {
+		t.Fatal(err)
+	}
+	if _, unchanged, err := checkFileChanged(store.db, path); err != nil || !unchanged {
+		t.Errorf("same size and time: unchanged %v, %v; want unchanged", unchanged, err)
+	}
+	modified := touched.Add(time.Minute)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	record, unchanged, err = checkFileChanged(store.db, path)
+	if err != nil || unchanged || record.Hash == "" || record.Hash == previous.Hash {
+		t.Errorf("after modification: %+v, %v, %v; want changed with a new hash", record, unchanged, err)
+	}
+
+	// A failed import is not a successful one to compare with
+	if err := recordFailedFile(store.db, path, 0, os.ErrPermission); err != nil {
+		t.Fatal(err)
+	}
+	if _, unchanged, err := checkFileChanged(store.db, path); err != nil || unchanged {
+		t.Errorf("after a failed import: unchanged %v, %v; want changed", unchanged, err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := checkFileChanged(store.db, path); err == nil {
+		t.Error("checked a deleted file; want an error")
+	}
+}
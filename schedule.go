@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JOB_SCHEDULE is the kind of the import jobs started by schedules.
+const JOB_SCHEDULE = "schedule"
+
+// SCHEDULE_SKIPPED is the status recorded for a scheduled run that did not
+// start because the schedule's previous run was still queued or running.
+const SCHEDULE_SKIPPED = "skipped"
+
+// MAX_SCHEDULE_RUNS is how many recent runs GET /schedules returns for each
+// schedule by default.
+const MAX_SCHEDULE_RUNS = 10
+
+// ScheduleConfig describes an import started on a cron schedule, such as a
+// nightly rescan of a share. The import options are those of ImportRequest;
+// Extensions default to every supported type.
+type ScheduleConfig struct {
+	Name string `json:"name"`
+	// Cron is a five field cron expression in local time, like "0 2 * * *"
+	// for every night at 02:00, or a descriptor like "@hourly"
+	Cron string `json:"cron"`
+	ImportRequest
+
+	schedule *cronSchedule
+}
+
+func (c *ScheduleConfig) validate() error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	schedule, err := parseCron(c.Cron)
+	if err != nil {
+		return err
+	}
+	if schedule.next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression %q never matches", c.Cron)
+	}
+	c.schedule = schedule
+
+	if len(c.Files) == 0 && len(c.Roots) == 0 {
+		return fmt.Errorf("files or roots are required")
+	}
+	if len(c.Extensions) == 0 {
+		c.Extensions = supportedExtensions()
+	}
+	if err := validateExtensions(c.Extensions); err != nil {
+		return err
+	}
+	if err := c.CSV.validate(); err != nil {
+		return err
+	}
+	if !validImportMode(c.Mode) {
+		return fmt.Errorf("invalid import mode %q", c.Mode)
+	}
+	return validateCrawl(c.ImportRequest)
+}
+
+// ScheduleStatus is a schedule as reported by GET /schedules.
+type ScheduleStatus struct {
+	Name       string      `json:"name"`
+	Cron       string      `json:"cron"`
+	Mode       string      `json:"mode"`
+	EmailOnly  bool        `json:"emailOnly"`
+	Roots      []string    `json:"roots"`
+	Files      []string    `json:"files"`
+	Extensions []string    `json:"extensions"`
+	NextRun    *time.Time  `json:"nextRun,omitempty"`
+	LastJobID  string      `json:"lastJobId,omitempty"`
+	Runs       []ImportRun `json:"runs"`
+}
+
+type scheduleEntry struct {
+	config  ScheduleConfig
+	next    time.Time // zero when the expression never matches again
+	lastJob string
+}
+
+// scheduler starts the import of every schedule when it is due.
+type scheduler struct {
+	mu      sync.Mutex
+	store   *Store
+	entries []*scheduleEntry
+}
+
+var schedules = &scheduler{}
+
+// startScheduler runs the configured schedules until ctx is cancelled. Runs
+// missed while the service was stopped are not made up for. tasks is done
+// once the scheduler has returned.
+func startScheduler(ctx context.Context, tasks *sync.WaitGroup, store *Store, configs []ScheduleConfig) {
+	if len(configs) == 0 {
+		return
+	}
+
+	now := time.Now()
+	schedules.mu.Lock()
+	schedules.store = store
+	for _, config := range configs {
+		entry := &scheduleEntry{config: config, next: config.schedule.next(now)}
+		schedules.entries = append(schedules.entries, entry)
+		log.Printf("Schedule %q (%s) next runs at %s", config.Name, config.Cron, entry.next.Format("2006-01-02 15:04"))
+	}
+	schedules.mu.Unlock()
+
+	tasks.Add(1)
+	go func() {
+		defer tasks.Done()
+		schedules.loop(ctx)
+	}()
+}
+
+func (s *scheduler) loop(ctx context.Context) {
+	for {
+		// Wake up at least every minute so that changes of the wall clock,
+		// like daylight saving time, are noticed
+		wait := time.Minute
+		s.mu.Lock()
+		for _, entry := range s.entries {
+			if until := time.Until(entry.next); !entry.next.IsZero() && until < wait {
+				wait = until
+			}
+		}
+		s.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			s.runDue(ctx, time.Now())
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runDue starts the schedules due at now and computes their next run.
+func (s *scheduler) runDue(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	var due []*scheduleEntry
+	for _, entry := range s.entries {
+		if !entry.next.IsZero() && !now.Before(entry.next) {
+			due = append(due, entry)
+			entry.next = entry.config.schedule.next(now)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, entry := range due {
+		s.start(ctx, entry)
+	}
+}
+
+// start queues the import of a schedule, or records a skipped run when its
+// previous import has not finished yet. Nothing is started once ctx is
+// cancelled.
+func (s *scheduler) start(ctx context.Context, entry *scheduleEntry) {
+	if ctx.Err() != nil {
+		return
+	}
+	config := entry.config
+
+	s.mu.Lock()
+	lastJob := entry.lastJob
+	s.mu.Unlock()
+	if previous, ok := jobQueue.get(lastJob); ok {
+		status := previous.snapshot().Status
+		if status == JOB_QUEUED || status == JOB_RUNNING {
+			log.Printf("Warning: Schedule %q skipped, job %s is still %s", config.Name, lastJob, status)
+			recordSkippedRun(s.store, config, fmt.Sprintf("Previous run %s still %s", lastJob, status))
+			return
+		}
+	}
+
+	req := config.ImportRequest
+	req.Schedule = config.Name
+	job, err := jobQueue.start(s.store, JOB_SCHEDULE, req)
+	if err != nil {
+		log.Printf("Error starting schedule %q: %v", config.Name, err)
+		return
+	}
+	log.Printf("Job %s queued by schedule %q", job.ID, config.Name)
+
+	s.mu.Lock()
+	entry.lastJob = job.ID
+	s.mu.Unlock()
+}
+
+func recordSkippedRun(store *Store, config ScheduleConfig, message string) {
+	database := store.database(config.EmailOnly)
+
+	run := &ImportRun{Kind: JOB_SCHEDULE, Schedule: config.Name}
+	err := beginImportRun(database, run)
+	if err == nil {
+		run.Status = SCHEDULE_SKIPPED
+		run.Message = message
+		err = finishImportRun(database, run)
+	}
+	if err != nil {
+		log.Printf("Error recording skipped run of schedule %q: %v", config.Name, err)
+	}
+}
+
+// schedulesHandler serves GET /schedules, the configured schedules with their
+// next run time and latest runs. ?limit= changes how many runs are returned
+// for each schedule.
+func (h *handlers) schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := MAX_SCHEDULE_RUNS
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+
+	schedules.mu.Lock()
+	statuses := make([]ScheduleStatus, 0, len(schedules.entries))
+	for _, entry := range schedules.entries {
+		config := entry.config
+		status := ScheduleStatus{
+			Name:       config.Name,
+			Cron:       config.Cron,
+			Mode:       config.Mode,
+			EmailOnly:  config.EmailOnly,
+			Roots:      config.Roots,
+			Files:      config.Files,
+			Extensions: config.Extensions,
+			LastJobID:  entry.lastJob,
+		}
+		if status.Mode == "" {
+			status.Mode = IMPORT_INCREMENTAL
+		}
+		if !entry.next.IsZero() {
+			next := entry.next
+			status.NextRun = &next
+		}
+		statuses = append(statuses, status)
+	}
+	schedules.mu.Unlock()
+
+	for i := range statuses {
+		database := h.store.database(statuses[i].EmailOnly)
+		runs, err := listImportRuns(database, statuses[i].Name, limit)
+		if err != nil {
+			log.Printf("Error listing runs of schedule %q: %v", statuses[i].Name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statuses[i].Runs = runs
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// rowSpool holds the rows read from a file until they are written to the
+// database. Files are read in full before the database is locked, so that
+// several files are read at once while only one is written. The first
+// ROW_BATCHES_IN_MEMORY batches are kept in memory and the rest is written
+// to a temporary file, so memory use does not grow with the size of a file.
+type rowSpool struct {
+	batches [][]sheetRow
+
+	temp    *os.File
+	writer  *bufio.Writer
+	encoder *gob.Encoder
+	spilled int // batches written to temp
+}
+
+// spooledRow is a sheetRow as written to the temporary file of a rowSpool.
+type spooledRow struct {
+	File    string
+	Sheet   string
+	Row     int
+	Content string
+	Cells   string
+	Headers []string
+	Skipped *RowError
+}
+
+// spoolRows reads the rows of the file of job, until the file ends or ctx
+// is cancelled. The spool returned must be closed.
+func spoolRows(ctx context.Context, job ImportJob) (*rowSpool, error) {
+	spool := &rowSpool{}
+	batch := make([]sheetRow, 0, ROW_BATCH_SIZE)
+	emit := func(row sheetRow) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if row.file == "" {
+			row.file = job.Path
+		}
+		batch = append(batch, row)
+		if len(batch) < ROW_BATCH_SIZE {
+			return nil
+		}
+		err := spool.add(batch)
+		batch = make([]sheetRow, 0, ROW_BATCH_SIZE)
+		return err
+	}
+
+	format, err := formatForFile(job.Path, job.Extension)
+	if err == nil {
+		err = format.reader.Read(job.Path, job.Options, emit)
+	}
+	if err == nil && len(batch) > 0 {
+		err = spool.add(batch)
+	}
+	if err == nil && spool.writer != nil {
+		err = spool.writer.Flush()
+	}
+	if err != nil {
+		spool.close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// add appends batch to the spool, in memory while there is room.
+func (s *rowSpool) add(batch []sheetRow) error {
+	if s.temp == nil && len(s.batches) < ROW_BATCHES_IN_MEMORY {
+		s.batches = append(s.batches, batch)
+		return nil
+	}
+
+	if s.temp == nil {
+		temp, err := os.CreateTemp("", "finder-rows-*")
+		if err != nil {
+			return fmt.Errorf("error spooling rows: %v", err)
+		}
+		s.temp = temp
+		s.writer = bufio.NewWriter(temp)
+		s.encoder = gob.NewEncoder(s.writer)
+	}
+	rows := make([]spooledRow, len(batch))
+	for i, row := range batch {
+		rows[i] = spooledRow{row.file, row.sheet, row.row, row.content, row.cells, row.headers, row.skipped}
+	}
+	if err := s.encoder.Encode(rows); err != nil {
+		return fmt.Errorf("error spooling rows: %v", err)
+	}
+	s.spilled++
+	return nil
+}
+
+// each calls fn with every batch of rows in the order they were read,
+// stopping at the first error fn returns.
+func (s *rowSpool) each(fn func([]sheetRow) error) error {
+	for _, batch := range s.batches {
+		if err := fn(batch); err != nil {
+			return err
+		}
+	}
+	if s.temp == nil {
+		return nil
+	}
+
+	if _, err := s.temp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading spooled rows: %v", err)
+	}
+	decoder := gob.NewDecoder(bufio.NewReader(s.temp))
+	for i := 0; i < s.spilled; i++ {
+		var rows []spooledRow
+		if err := decoder.Decode(&rows); err != nil {
+			return fmt.Errorf("error reading spooled rows: %v", err)
+		}
+		batch := make([]sheetRow, len(rows))
+		for j, row := range rows {
+			batch[j] = sheetRow{
+				file:    row.File,
+				sheet:   row.Sheet,
+				row:     row.Row,
+				content: row.Content,
+				cells:   row.Cells,
+				headers: row.Headers,
+				skipped: row.Skipped,
+			}
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close removes the temporary file of the spool, if any.
+func (s *rowSpool) close() {
+	if s.temp != nil {
+		s.temp.Close()
+		os.Remove(s.temp.Name())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpoolRows(t *testing.T) {
+	// Enough rows for some to be spooled to the temporary file
+	rows := ROW_BATCH_SIZE*ROW_BATCHES_IN_MEMORY + ROW_BATCH_SIZE/2
+	var csv strings.Builder
+	csv.WriteString("Name,Phone\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&csv, "Name %d,%d\n", i, i)
+	}
+	path := filepath.Join(t.TempDir(), "big.csv")
+	if err := os.WriteFile(path, []byte(csv.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := spoolRows(context.Background(), ImportJob{Path: path, Extension: "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spool.temp == nil {
+		t.Fatalf("%d rows were all kept in memory", rows)
+	}
+	temp := spool.temp.Name()
+
+	read := 0
+	err = spool.each(func(batch []sheetRow) error {
+		for _, row := range batch {
+			want := fmt.Sprintf("Name %d", read)
+			if row.file != path || row.sheet == "" || row.row != read+2 || !strings.Contains(row.content, want) {
+				return fmt.Errorf("row %d is %+v; want %q on line %d", read, row, want, read+2)
+			}
+			if len(row.headers) != 2 {
+				return fmt.Errorf("row %d has headers %q", read, row.headers)
+			}
+			read++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != rows {
+		t.Errorf("read back %d rows; want %d", read, rows)
+	}
+
+	spool.close()
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("spool file %s left behind: %v", temp, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SQLITE_PRAGMAS are the connection settings of both databases.
+const SQLITE_PRAGMAS = "?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)&_pragma=temp_store(MEMORY)&_pragma=mmap_size(30000000000)&_pragma=cache_size(-2000)&_pragma=page_size(4096)"
+
+// Store holds the main database and the email database. It is created with
+// newStore, opened with Open and its tables created or upgraded with
+// Migrate before use.
+type Store struct {
+	path      string
+	emailPath string
+
+	db      *sql.DB
+	emailDB *sql.DB
+}
+
+func newStore(path, emailPath string) *Store {
+	return &Store{path: path, emailPath: emailPath}
+}
+
+// database returns the email database if emailOnly is set, else the main one.
+func (s *Store) database(emailOnly bool) *sql.DB {
+	if emailOnly {
+		return s.emailDB
+	}
+	return s.db
+}
+
+// Open opens both databases, creating their directories if needed.
+func (s *Store) Open() error {
+	var err error
+	for _, path := range []string{s.path, s.emailPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("error creating data directory: %v", err)
+		}
+	}
+
+	// Open main database with optimized settings
+	s.db, err = sql.Open(SQLITE_DRIVER, s.path+SQLITE_PRAGMAS)
+	if err != nil {
+		return fmt.Errorf("error opening database %s: %v", s.path, err)
+	}
+
+	// Open email database with optimized settings
+	s.emailDB, err = sql.Open(SQLITE_DRIVER, s.emailPath+SQLITE_PRAGMAS)
+	if err != nil {
+		s.db.Close()
+		return fmt.Errorf("error opening database %s: %v", s.emailPath, err)
+	}
+
+	// Set connection pool settings for both databases
+	for _, d := range []*sql.DB{s.db, s.emailDB} {
+		d.SetMaxOpenConns(1)
+		d.SetMaxIdleConns(1)
+		d.SetConnMaxLifetime(time.Hour)
+	}
+
+	// Set additional PRAGMAs for optimization for both databases
+	for _, d := range []*sql.DB{s.db, s.emailDB} {
+		_, err = d.Exec(`
+			PRAGMA synchronous = NORMAL;
+			PRAGMA journal_mode = WAL;
+			PRAGMA busy_timeout = 5000;
+			PRAGMA temp_store = MEMORY;
+			PRAGMA mmap_size = 30000000000;
+			PRAGMA cache_size = -2000;
+			PRAGMA page_size = 4096;
+			PRAGMA auto_vacuum = INCREMENTAL;
+		`)
+		if err != nil {
+			log.Printf("Warning: Could not set all PRAGMAs: %v", err)
+		}
+	}
+	return nil
+}
+
+// Migrate creates the tables of both databases, or brings those of older
+// versions up to date.
+func (s *Store) Migrate() error {
+	if err := migrate(s.db, s.path, mainSchema); err != nil {
+		return err
+	}
+	if err := migrate(s.emailDB, s.emailPath, emailSchema); err != nil {
+		return err
+	}
+
+	// Check initial database sizes
+	log.Printf("Checking initial database sizes")
+	if err := checkDatabaseSize(s.db); err != nil {
+		log.Printf("Warning: Could not check initial database size: %v", err)
+	}
+
+	// Verify initial state
+	log.Printf("Verifying initial table state")
+	if err := verifyTableState(s.db); err != nil {
+		log.Printf("Warning: Could not verify initial table state: %v", err)
+	}
+	return nil
+}
+
+// reset drops the content, index and registry tables of one database and
+// creates them again empty. The history of import runs is kept.
+func (s *Store) reset(emailOnly bool) error {
+	if emailOnly {
+		return resetSchema(s.emailDB, s.emailPath, emailSchema)
+	}
+	return resetSchema(s.db, s.path, mainSchema)
+}
+
+// Close closes both databases.
+func (s *Store) Close() error {
+	var firstErr error
+	for _, d := range []*sql.DB{s.db, s.emailDB} {
+		if d == nil {
+			continue
+		}
+		if err := d.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error closing database: %v", err)
+		}
+	}
+	return firstErr
+}
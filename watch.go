@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// JOB_WATCH is the kind of the import jobs started by watched folders.
+const JOB_WATCH = "watch"
+
+// Defaults for watched folders
+const (
+	// WATCH_DEBOUNCE is how long a folder must stay quiet after a change
+	// before it is imported, so files still being copied are not read
+	WATCH_DEBOUNCE = 2 * time.Second
+	// WATCH_POLL_INTERVAL is how often folders are rescanned when they
+	// cannot be watched for changes
+	WATCH_POLL_INTERVAL = time.Minute
+)
+
+// WatchConfig describes a folder whose spreadsheets are imported
+// automatically: new and changed files are imported incrementally and the
+// rows of deleted files are removed.
+type WatchConfig struct {
+	Path       string   `json:"path"`
+	Extensions []string `json:"extensions"`
+	EmailOnly  bool     `json:"emailOnly"`
+	// Include, Exclude, MaxDepth, Symlinks and CSV work as in ImportRequest
+	Include  []string   `json:"include"`
+	Exclude  []string   `json:"exclude"`
+	MaxDepth int        `json:"maxDepth"`
+	Symlinks string     `json:"symlinks"`
+	CSV      CSVOptions `json:"csv"`
+	// Poll rescans the folder every Interval instead of watching it, for
+	// network shares that do not report changes
+	Poll     bool   `json:"poll"`
+	Interval string `json:"interval"`
+
+	interval time.Duration
+}
+
+func (c *WatchConfig) validate() error {
+	if strings.TrimSpace(c.Path) == "" {
+		return fmt.Errorf("path is required")
+	}
+	c.Path = filepath.Clean(c.Path)
+	if len(c.Extensions) == 0 {
+		c.Extensions = supportedExtensions()
+	}
+	if err := validateExtensions(c.Extensions); err != nil {
+		return err
+	}
+	if err := c.CSV.validate(); err != nil {
+		return err
+	}
+
+	c.interval = WATCH_POLL_INTERVAL
+	if c.Interval != "" {
+		interval, err := time.ParseDuration(c.Interval)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("invalid interval %q", c.Interval)
+		}
+		c.interval = interval
+	}
+	return validateCrawl(c.importRequest())
+}
+
+// importRequest returns the request importing the whole folder.
+func (c *WatchConfig) importRequest() ImportRequest {
+	return ImportRequest{
+		Roots:      []string{c.Path},
+		Extensions: c.Extensions,
+		EmailOnly:  c.EmailOnly,
+		Mode:       IMPORT_INCREMENTAL,
+		Include:    c.Include,
+		Exclude:    c.Exclude,
+		MaxDepth:   c.MaxDepth,
+		Symlinks:   c.Symlinks,
+		CSV:        c.CSV,
+	}
+}
+
+// startWatchers watches every configured folder until ctx is cancelled.
+// tasks is done once every watcher has returned.
+func startWatchers(ctx context.Context, tasks *sync.WaitGroup, store *Store, configs []WatchConfig) {
+	for _, config := range configs {
+		tasks.Add(1)
+		go func(config WatchConfig) {
+			defer tasks.Done()
+			watchFolder(ctx, store, config)
+		}(config)
+	}
+}
+
+// watchFolder first brings the index up to date with the folder, then
+// follows its changes with fsnotify, or by polling when the folder cannot
+// be watched.
+func watchFolder(ctx context.Context, store *Store, config WatchConfig) {
+	log.Printf("Watching folder %s", config.Path)
+	syncFolder(ctx, store, config, nil)
+
+	if !config.Poll {
+		err := followFolder(ctx, store, config)
+		if err == nil {
+			return
+		}
+		log.Printf("Warning: Cannot watch %s, polling every %v instead: %v", config.Path, config.interval, err)
+	}
+
+	pollFolder(ctx, store, config)
+}
+
+// pollFolder rescans the folder every config.interval and syncs it when a
+// file was added, changed or deleted since the previous scan.
+func pollFolder(ctx context.Context, store *Store, config WatchConfig) {
+	previous, _ := scanFolder(ctx, config)
+
+	ticker := time.NewTicker(config.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			current, err := scanFolder(ctx, config)
+			if err != nil {
+				log.Printf("Warning: Scanning %s: %v", config.Path, err)
+				continue
+			}
+			if !sameScan(previous, current) {
+				syncFolder(ctx, store, config, nil)
+			}
+			previous = current
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fileStamp is what polling compares to tell whether a file changed.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// scanFolder returns the size and modification time of every file a crawl
+// of the folder would import.
+func scanFolder(ctx context.Context, config WatchConfig) (map[string]fileStamp, error) {
+	req := config.importRequest()
+	files, _, err := planImport(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	stamps := make(map[string]fileStamp, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file.Path); err == nil {
+			stamps[file.Path] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		}
+	}
+	return stamps, nil
+}
+
+func sameScan(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, stamp := range a {
+		other, ok := b[path]
+		if !ok || other.size != stamp.size || !other.modTime.Equal(stamp.modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// followFolder imports the paths fsnotify reports as changed once the folder
+// has been quiet for WATCH_DEBOUNCE. It returns an error if the folder cannot
+// be watched, and nil when ctx is cancelled.
+func followFolder(ctx context.Context, store *Store, config WatchConfig) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := addWatches(watcher, config.Path); err != nil {
+		return err
+	}
+
+	changed := make(map[string]bool)
+	debounce := time.NewTimer(WATCH_DEBOUNCE)
+	debounce.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			if event.Has(fsnotify.Chmod) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			// New directories are watched too; their files may never
+			// produce events of their own
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := addWatches(watcher, event.Name); err != nil {
+						log.Printf("Warning: Cannot watch %s: %v", event.Name, err)
+					}
+				}
+			}
+			changed[event.Name] = true
+			resetTimer(debounce, WATCH_DEBOUNCE)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("watcher closed")
+			}
+			// Events may have been lost, so rescan everything
+			log.Printf("Warning: Watching %s: %v", config.Path, err)
+			changed[config.Path] = true
+			resetTimer(debounce, WATCH_DEBOUNCE)
+
+		case <-debounce.C:
+			var paths []string
+			for path := range changed {
+				paths = append(paths, path)
+			}
+			changed = make(map[string]bool)
+			syncFolder(ctx, store, config, paths)
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// resetTimer restarts t to fire after d. A stopped timer that already fired
+// is drained first, so that its stale tick does not end the new wait early.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// addWatches watches dir and every directory below it.
+func addWatches(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if entry.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// syncFolder removes the rows of files under the folder that no longer exist
+// and queues an incremental import of the changed files, or of the whole
+// folder when changed is nil or includes a directory. Nothing is done while
+// the folder cannot be read, e.g. when its share is offline, or once ctx is
+// cancelled.
+func syncFolder(ctx context.Context, store *Store, config WatchConfig, changed []string) {
+	if ctx.Err() != nil {
+		return
+	}
+	if _, err := folderEmpty(config.Path); err != nil {
+		log.Printf("Warning: Skipping sync of %s, its files stay in the index: %v", config.Path, err)
+		return
+	}
+
+	removed, err := removeMissingFiles(ctx, store, config.EmailOnly, config.Path)
+	if err != nil {
+		log.Printf("Error removing deleted files of %s: %v", config.Path, err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d deleted files of %s from the index", removed, config.Path)
+	}
+
+	req := config.importRequest()
+	if changed != nil {
+		filter := newCrawler(req)
+		rescan := false
+		var files []string
+		for _, path := range changed {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue // removed again, or renamed away
+			}
+			if info.IsDir() {
+				// A directory moved in, or lost events: rescan the folder
+				rescan = true
+				break
+			}
+			rel, err := filepath.Rel(config.Path, path)
+			if err == nil && filter.allowed(rel, false) {
+				files = append(files, path)
+			}
+		}
+		if !rescan {
+			if len(importJobs(files, req.Extensions)) == 0 {
+				return
+			}
+			req.Roots = nil
+			req.Files = files
+		}
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+	job, err := jobQueue.start(store, JOB_WATCH, req)
+	if err != nil {
+		log.Printf("Error importing %s: %v", config.Path, err)
+		return
+	}
+	log.Printf("Job %s queued for changes in %s", job.ID, config.Path)
+}
+
+// removeMissingFiles removes the rows of the files registered under dir that
+// no longer exist, and returns how many files were removed. An offline
+// share reports its files as missing, and an unmounted one looks like an
+// empty folder, so nothing is removed unless dir can be read, nor when it
+// is empty and every registered file is missing. It stops early when ctx is
+// cancelled.
+func removeMissingFiles(ctx context.Context, store *Store, emailOnly bool, dir string) (int, error) {
+	empty, err := folderEmpty(dir)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %s: %v", dir, err)
+	}
+
+	database := store.database(emailOnly)
+	paths, err := registeredFilesUnder(database, dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var missing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			missing = append(missing, path)
+		}
+	}
+	if empty && len(missing) > 0 && len(missing) == len(paths) {
+		log.Printf("Warning: %s is empty, keeping its %d files in the index in case it is not mounted", dir, len(paths))
+		return 0, nil
+	}
+
+	removed := 0
+	for _, path := range missing {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		if _, err := removeFile(database, emailOnly, path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// folderEmpty reports whether dir has no entries. It fails unless dir exists,
+// is a directory and can be listed.
+func folderEmpty(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}